@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newAddedKey constructs an sshKey for a key added to the agent by a client
+// at the given time.
+func newAddedKey(key agent.AddedKey, now time.Time) (*sshKey, error) {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	// Keep an encoded copy of the key, so that we can seal it while locked.
+	blk, err := ssh.MarshalPrivateKey(key.PrivateKey, key.Comment)
+	if err != nil {
+		return nil, err
+	}
+	sk := &sshKey{
+		Signer:  signer,
+		Comment: key.Comment,
+		Confirm: key.ConfirmBeforeUse,
+		Data:    pem.EncodeToMemory(blk),
+	}
+	if key.Certificate != nil {
+		if !bytes.Equal(key.Certificate.Key.Marshal(), signer.PublicKey().Marshal()) {
+			return nil, errors.New("certificate does not match the key")
+		}
+		sk.Cert = key.Certificate
+	}
+	if key.LifetimeSecs > 0 {
+		sk.Expires = now.Add(time.Duration(key.LifetimeSecs) * time.Second)
+	}
+	return sk, nil
+}
+
+// pruneAdded discards expired keys added by clients.
+func (s *Server) pruneAdded() {
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	s.pruneAddedLocked(time.Now())
+}
+
+// pruneAddedLocked discards keys added by clients that have expired as of
+// now. The caller must hold s.μ.
+func (s *Server) pruneAddedLocked(now time.Time) {
+	for id, sk := range s.added {
+		if sk.expired(now) {
+			delete(s.added, id)
+			s.logPrintf("Expired added key %s", ssh.FingerprintSHA256(sk.Signer.PublicKey()))
+		}
+	}
+}
+
+// dropAddedLocked discards keys added by clients that are also among the
+// keys from the secrets service, so that each key is served only once. The
+// caller must hold s.μ.
+func (s *Server) dropAddedLocked(keys map[string]*sshKey) {
+	for id, sk := range s.added {
+		if key, ok := keys[id]; ok {
+			delete(s.added, id)
+			s.logPrintf("Dropped added key %s, now provided by %q",
+				ssh.FingerprintSHA256(sk.Signer.PublicKey()), key.Name)
+		}
+	}
+}
+
+// An addedKeyRecord is the form in which a key added by a client is sealed
+// while the agent is locked.
+type addedKeyRecord struct {
+	Key     []byte    // PEM-encoded private key, including the comment
+	Cert    []byte    `json:",omitempty"` // certificate, in wire format
+	Confirm bool      `json:",omitempty"`
+	Expires time.Time `json:",omitzero"`
+}
+
+// sealAddedKeys encrypts the specified added keys with key. If there are no
+// keys to seal, it returns nil.
+func sealAddedKeys(key []byte, added map[string]*sshKey) ([]byte, error) {
+	if len(added) == 0 {
+		return nil, nil
+	}
+	var recs []addedKeyRecord
+	for _, sk := range added {
+		rec := addedKeyRecord{Key: sk.Data, Confirm: sk.Confirm, Expires: sk.Expires}
+		if sk.Cert != nil {
+			rec.Cert = sk.Cert.Marshal()
+		}
+		recs = append(recs, rec)
+	}
+	plain, err := json.Marshal(recs)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// openAddedKeys decrypts keys sealed by sealAddedKeys with key.
+// If data == nil, it returns nil.
+func openAddedKeys(key, data []byte) (map[string]*sshKey, error) {
+	if data == nil {
+		return nil, nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	var recs []addedKeyRecord
+	if err := json.Unmarshal(plain, &recs); err != nil {
+		return nil, err
+	}
+	out := make(map[string]*sshKey)
+	for _, rec := range recs {
+		sk, err := parseStoredKey("", 0, rec.Key, nil)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Cert != nil {
+			pub, err := ssh.ParsePublicKey(rec.Cert)
+			if err != nil {
+				return nil, err
+			}
+			cert, ok := pub.(*ssh.Certificate)
+			if !ok {
+				return nil, fmt.Errorf("got %s key, not a certificate", pub.Type())
+			}
+			sk.Cert = cert
+		}
+		sk.Confirm, sk.Expires, sk.Data = rec.Confirm, rec.Expires, rec.Key
+		out[sk.mapID()] = sk
+	}
+	return out, nil
+}
+
+// newAEAD returns an AES-GCM cipher using the specified 32-byte key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
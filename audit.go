@@ -0,0 +1,182 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// A SignRecord is an audit record describing a signature made by the agent.
+type SignRecord struct {
+	Time        time.Time
+	Secret      string            // the secret name; "" for added keys
+	Version     api.SecretVersion // the secret version; 0 for added keys
+	Fingerprint string            // the SHA256 fingerprint of the key
+	Comment     string            // the key comment
+	Peer        *Peer             // the peer requesting the signature, if known
+	Labels      map[string]string // labels from the key envelope, if any
+
+	// Kind describes what kind of data was signed. The remaining fields are
+	// populated according to the kind.
+	Kind DataKind
+
+	// Fields populated for DataUserAuth.
+	SessionID []byte // the SSH session identifier
+	User      string // the user name to authenticate as
+	Service   string // the service name requested
+	Algorithm string // the public key algorithm
+	HostKey   []byte // the server host key, if the request is host-bound
+
+	// Fields populated for DataSSHSig.
+	Namespace     string // the signature namespace, e.g., "file" or "git"
+	HashAlgorithm string // the hash algorithm used for the message
+}
+
+// String returns a human-readable summary of r, suitable for logging.
+func (r SignRecord) String() string {
+	key := fmt.Sprintf("key %s (%q)", r.Fingerprint, r.Comment)
+	if r.Secret != "" {
+		key = fmt.Sprintf("key %s from %q version %d", r.Fingerprint, r.Secret, r.Version)
+	}
+	if r.Peer != nil {
+		key += " for " + r.Peer.String()
+	}
+	switch r.Kind {
+	case DataUserAuth:
+		return fmt.Sprintf("Signed userauth request for user %q service %q (%s, session %x) with %s",
+			r.User, r.Service, r.Algorithm, r.SessionID, key)
+	case DataSSHSig:
+		return fmt.Sprintf("Signed SSHSIG message in namespace %q (%s) with %s", r.Namespace, r.HashAlgorithm, key)
+	default:
+		return fmt.Sprintf("WARNING: Signed unrecognized data with %s", key)
+	}
+}
+
+// DataKind describes the kind of data presented to the agent for signing.
+type DataKind string
+
+const (
+	DataUserAuth DataKind = "userauth" // an SSH publickey userauth request
+	DataSSHSig   DataKind = "sshsig"   // an SSHSIG message signature
+	DataUnknown  DataKind = "unknown"  // data in an unrecognized format
+)
+
+// audit reports the signature described by rec to the audit hook if one is
+// set, or to the log otherwise.
+func (s *Server) audit(rec SignRecord) {
+	if s.auditf != nil {
+		s.auditf(rec)
+	} else {
+		s.logPrintf("%s", rec)
+	}
+}
+
+// newSignRecord returns a SignRecord for a signature of data made by sk.
+func newSignRecord(sk *sshKey, data []byte) SignRecord {
+	rec := SignRecord{
+		Time:        time.Now(),
+		Secret:      sk.Name,
+		Version:     sk.Version,
+		Fingerprint: ssh.FingerprintSHA256(sk.Signer.PublicKey()),
+		Comment:     sk.Comment,
+		Labels:      maps.Clone(sk.Labels),
+		Kind:        DataUnknown,
+	}
+	if !parseUserAuth(data, &rec) {
+		parseSSHSig(data, &rec)
+	}
+	return rec
+}
+
+// userAuthRequest is the SSH_MSG_USERAUTH_REQUEST message number.
+const userAuthRequest = 50
+
+// parseUserAuth reports whether data is a publickey userauth request, as
+// signed by SSH clients (RFC 4252 section 7), and if so populates rec with its
+// contents.
+func parseUserAuth(data []byte, rec *SignRecord) bool {
+	s := newScanner(data)
+	sid, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	if mt, err := s.scanByte(); err != nil || mt != userAuthRequest {
+		return false
+	}
+	user, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	service, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	method, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	hostBound := string(method) == "publickey-hostbound-v00@openssh.com"
+	if string(method) != "publickey" && !hostBound {
+		return false
+	}
+	if hasSig, err := s.scanByte(); err != nil || hasSig == 0 {
+		return false
+	}
+	algo, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	if err := s.skipStrings(1); err != nil { // public key blob
+		return false
+	}
+	var hostKey []byte
+	if hostBound {
+		if hostKey, err = s.scanString(); err != nil {
+			return false
+		}
+	}
+	if !s.atEOF() {
+		return false
+	}
+	rec.Kind = DataUserAuth
+	rec.SessionID = bytes.Clone(sid)
+	rec.User = string(user)
+	rec.Service = string(service)
+	rec.Algorithm = string(algo)
+	rec.HostKey = bytes.Clone(hostKey)
+	return true
+}
+
+// parseSSHSig reports whether data is an SSHSIG signed data blob, as defined
+// by PROTOCOL.sshsig in OpenSSH, and if so populates rec with its contents.
+func parseSSHSig(data []byte, rec *SignRecord) bool {
+	s := newScanner(data)
+	if err := s.scanLiteral("SSHSIG"); err != nil {
+		return false
+	}
+	namespace, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	if err := s.skipStrings(1); err != nil { // reserved
+		return false
+	}
+	hashAlgo, err := s.scanString()
+	if err != nil {
+		return false
+	}
+	if err := s.skipStrings(1); err != nil || !s.atEOF() { // message hash
+		return false
+	}
+	rec.Kind = DataSSHSig
+	rec.Namespace = string(namespace)
+	rec.HashAlgorithm = string(hashAlgo)
+	return true
+}
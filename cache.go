@@ -0,0 +1,159 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// A Cache is persistent storage for a single blob of data. It is satisfied by
+// the FileCache type from the setec client package.
+type Cache interface {
+	Write([]byte) error
+	Read() ([]byte, error)
+}
+
+// CacheKeyLen is the required length in bytes of Config.CacheKey.
+const CacheKeyLen = 32
+
+// cacheData is the plaintext format of the key cache.
+type cacheData struct {
+	Saved time.Time   // when the cached keys were confirmed current
+	Keys  []cachedKey `json:",omitempty"`
+}
+
+// A cachedKey records a key from the secrets service in the cache.
+type cachedKey struct {
+	Name        string
+	Version     api.SecretVersion
+	Key         []byte            // the secret value, with the key decrypted
+	Cert        []byte            `json:",omitempty"` // authorized_keys format
+	CertVersion api.SecretVersion `json:",omitempty"`
+	PassVersion api.SecretVersion `json:",omitempty"`
+	PassName    string            `json:",omitempty"`
+	Bundle      int               `json:",omitempty"`
+	Checked     time.Time         `json:",omitzero"` // if zero, use cacheData.Saved
+}
+
+// saveCache writes the current keys from the secrets service to the cache,
+// recording that they were current as of saved.
+func (s *Server) saveCache(saved time.Time) error {
+	data := cacheData{Saved: saved}
+	s.μ.Lock()
+	if s.locked {
+		s.μ.Unlock()
+		return nil // nothing to save
+	}
+	for _, key := range s.keys {
+		ck := cachedKey{
+			Name:        key.Name,
+			Version:     key.Version,
+			Key:         key.Data,
+			CertVersion: key.CertVersion,
+			PassVersion: key.PassVersion,
+			PassName:    key.PassName,
+			Bundle:      key.Bundle,
+			Checked:     key.Checked,
+		}
+		if key.Cert != nil {
+			ck.Cert = ssh.MarshalAuthorizedKey(key.Cert)
+		}
+		data.Keys = append(data.Keys, ck)
+	}
+	s.μ.Unlock()
+
+	plain, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(s.cacheKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return s.cache.Write(aead.Seal(nonce, nonce, plain, nil))
+}
+
+// LoadCache loads keys from the cache (see Config.Cache), replacing the keys
+// currently held by s. It is intended for use when the initial Update fails,
+// so that the agent can serve the last known keys until the secrets service
+// is reachable again. Keys loaded from the cache are subject to the maximum
+// staleness (Config.MaxStale) as of when they were last confirmed current
+// before the cache was saved.
+//
+// LoadCache reports an error without modifying s if there is no cache, it
+// cannot be decrypted, or it is older than Config.CacheMaxAge.
+func (s *Server) LoadCache() error {
+	if s.cache == nil {
+		return errors.New("no cache is configured")
+	}
+	sealed, err := s.cache.Read()
+	if err != nil {
+		return fmt.Errorf("read cache: %w", err)
+	}
+	aead, err := newAEAD(s.cacheKey)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("cache data is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("decrypt cache: %w", err)
+	}
+	var data cacheData
+	if err := json.Unmarshal(plain, &data); err != nil {
+		return fmt.Errorf("decode cache: %w", err)
+	}
+	now := time.Now()
+	if age := now.Sub(data.Saved); s.cacheMaxAge > 0 && age > s.cacheMaxAge {
+		return fmt.Errorf("cache is too old (%v > %v)", age.Round(time.Second), s.cacheMaxAge)
+	}
+
+	keys := make(map[string]*sshKey)
+	for _, ck := range data.Keys {
+		key, err := parseStoredKey(ck.Name, ck.Version, ck.Key, nil)
+		if err != nil {
+			return fmt.Errorf("cached key %q: %w", ck.Name, err)
+		}
+		key.Data, key.Checked = ck.Key, data.Saved
+		if !ck.Checked.IsZero() && ck.Checked.Before(data.Saved) {
+			key.Checked = ck.Checked // not confirmed by the last (partial) update
+		}
+		key.CertVersion, key.PassVersion, key.Bundle = ck.CertVersion, ck.PassVersion, ck.Bundle
+		key.PassName = ck.PassName
+		if ck.Cert != nil {
+			cert, err := parseCert(ck.Cert, key.Signer.PublicKey())
+			if err != nil {
+				s.logPrintf("WARNING: skipped cached certificate for %q (%v)", ck.Name, err)
+			} else {
+				key.Cert = cert
+			}
+		}
+		s.applyComment(key)
+		s.applyPolicy(key)
+		keys[key.mapID()] = key
+	}
+
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	if s.locked {
+		return errLocked
+	}
+	s.dropAddedLocked(keys)
+	s.keys = keys
+	s.logPrintf("Loaded %d keys from cache saved at %v", len(keys), data.Saved.Format(time.RFC3339))
+	return nil
+}
@@ -7,25 +7,56 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
+	"github.com/creachadair/taskgroup"
 	"github.com/tailscale/setec/client/setec"
 	"github.com/tailscale/tskagent"
 )
 
 var flags struct {
-	Server string        `flag:"server,Secret server address (required)"`
-	Socket string        `flag:"socket,Agent socket path (required)"`
-	Prefix string        `flag:"prefix,Secret name prefix (required)"`
-	Update time.Duration `flag:"update,Automatic update interval (0 means no updates)"`
+	Server   string        `flag:"server,Secret server address (required)"`
+	Socket   string        `flag:"socket,Agent socket path (required)"`
+	Prefix   string        `flag:"prefix,Secret name prefix"`
+	Include  string        `flag:"include,Comma-separated secret name patterns to serve (a trailing / matches a directory)"`
+	Exclude  string        `flag:"exclude,Comma-separated secret name patterns not to serve"`
+	Depth    int           `flag:"max-depth,Maximum depth of secrets below a matching directory (0 means no limit)"`
+	Names    string        `flag:"names,Comma-separated names of secrets to serve"`
+	Manifest string        `flag:"manifest,Name of a secret listing the names of secrets to serve"`
+	Update   time.Duration `flag:"update,Automatic update interval (0 means no updates)"`
+	Grace    time.Duration `flag:"rotation-grace,Time to keep serving the previous key after a secret is rotated (0 means none)"`
+	OnMiss   time.Duration `flag:"update-on-miss,Minimum interval between updates for requests for unknown keys (0 means none)"`
+	Stale    time.Duration `flag:"max-stale,Withhold keys not confirmed current within this time (0 means no limit)"`
+	Cache    string        `flag:"cache,Path of an encrypted cache of keys, used if setec is unreachable at startup"`
+	KeyFile  string        `flag:"cache-key,Path of the cache encryption key, created if missing (default tskagent/cache.key in the user config directory)"`
+	MaxAge   time.Duration `flag:"cache-max-age,Maximum age of the cache to load at startup (0 means no limit)"`
+	Atomic   bool          `flag:"strict-update,Apply updates only if all secrets can be fetched"`
+	Workers  int           `flag:"update-concurrency,Maximum number of secrets to fetch concurrently (0 means a default)"`
+	Add      bool          `flag:"allow-add,Allow clients to add keys held only in memory"`
+	Askpass  string        `flag:"askpass,Program to run to confirm use of keys (default $SSH_ASKPASS)"`
+	Comment  string        `flag:"comment-template,Comment for keys without one, e.g. {name}; fields are {name} {basename} {version} {comment} {fingerprint}"`
+	Confirm  string        `flag:"confirm,Comma-separated secret name patterns whose keys require confirmation"`
+	Strict   bool          `flag:"strict-sign,Refuse to sign data other than SSH userauth requests and SSHSIG messages"`
+	Policy   string        `flag:"policy,Path of a JSON file of key usage policies"`
+	Known    string        `flag:"known-hosts,Comma-separated known_hosts files for host policies (default ~/.ssh/known_hosts)"`
+	UIDs     string        `flag:"allow-uid,Comma-separated user IDs permitted to connect"`
+	GIDs     string        `flag:"allow-gid,Comma-separated group IDs permitted to connect"`
 }
 
 func main() {
@@ -35,6 +66,16 @@ func main() {
 		SetFlags: command.Flags(flax.MustBind, &flags),
 		Run:      command.Adapt(run),
 		Commands: []*command.C{
+			{
+				Name:  "validate",
+				Usage: "<file>...",
+				Help: `Check the values of key secrets stored in files.
+
+Each file should contain the value of a key secret: Either a private key in
+PEM format, or a JSON key envelope, or a bundle of several keys. Each problem
+found is reported. Use "-" to read from stdin.`,
+				Run: command.Adapt(runValidate),
+			},
 			command.HelpCommand(nil),
 			command.VersionCommand(),
 		},
@@ -50,8 +91,16 @@ func run(env *command.Env) error {
 		return env.Usagef("a secret --server address is required")
 	case flags.Socket == "":
 		return env.Usagef("an agent --socket path is required")
-	case flags.Prefix == "":
-		return env.Usagef("a secret name --prefix is required")
+	case flags.Prefix == "" && flags.Include == "" && flags.Names == "" && flags.Manifest == "":
+		return env.Usagef("a secret name --prefix, --include, --names, or --manifest is required")
+	}
+	uids, err := parseIDs(flags.UIDs)
+	if err != nil {
+		return env.Usagef("invalid --allow-uid: %v", err)
+	}
+	gids, err := parseIDs(flags.GIDs)
+	if err != nil {
+		return env.Usagef("invalid --allow-gid: %v", err)
 	}
 	cli := setec.Client{Server: flags.Server}
 	lst, err := net.Listen("unix", flags.Socket)
@@ -60,24 +109,191 @@ func run(env *command.Env) error {
 	}
 	defer os.Remove(flags.Socket) // best-effort
 
-	srv := tskagent.NewServer(tskagent.Config{
-		Client: cli,
-		Prefix: flags.Prefix,
-		Logf:   log.Printf,
+	var policies []tskagent.KeyPolicy
+	if flags.Policy != "" {
+		data, err := os.ReadFile(flags.Policy)
+		if err != nil {
+			return fmt.Errorf("read policy: %w", err)
+		}
+		if err := json.Unmarshal(data, &policies); err != nil {
+			return fmt.Errorf("parse policy: %w", err)
+		}
+	}
+	// Confirmation applies from any matching policy, so these need not
+	// precede the policies from the file.
+	for _, pat := range splitList(flags.Confirm) {
+		policies = append(policies, tskagent.KeyPolicy{Match: pat, Confirm: true})
+	}
+	if flags.Askpass == "" {
+		flags.Askpass = os.Getenv("SSH_ASKPASS")
+	}
+	knownHosts := splitList(flags.Known)
+	if len(knownHosts) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			path := filepath.Join(home, ".ssh", "known_hosts")
+			if _, err := os.Stat(path); err == nil {
+				knownHosts = append(knownHosts, path)
+			}
+		}
+	}
+
+	var cache tskagent.Cache
+	var cacheKey []byte
+	if flags.Cache != "" {
+		fc, err := setec.NewFileCache(flags.Cache)
+		if err != nil {
+			return fmt.Errorf("open cache: %w", err)
+		}
+		cache = fc
+		keyFile := flags.KeyFile
+		if keyFile == "" {
+			dir, err := os.UserConfigDir()
+			if err != nil {
+				return fmt.Errorf("cache key: %w (use --cache-key)", err)
+			}
+			keyFile = filepath.Join(dir, "tskagent", "cache.key")
+		}
+		cacheKey, err = loadOrCreateKey(keyFile)
+		if err != nil {
+			return fmt.Errorf("cache key: %w", err)
+		}
+	}
+
+	srv, err := tskagent.NewServer(tskagent.Config{
+		Client:     cli,
+		Prefix:     flags.Prefix,
+		Include:    splitList(flags.Include),
+		Exclude:    splitList(flags.Exclude),
+		MaxDepth:   flags.Depth,
+		Names:      splitList(flags.Names),
+		Manifest:   flags.Manifest,
+		Logf:       log.Printf,
+		AllowAdd:   flags.Add,
+		Policies:   policies,
+		Askpass:    flags.Askpass,
+		StrictSign: flags.Strict,
+		KnownHosts: knownHosts,
+		AllowUIDs:  uids,
+		AllowGIDs:  gids,
+
+		StrictUpdate:       flags.Atomic,
+		MissUpdateInterval: flags.OnMiss,
+		RotationGrace:      flags.Grace,
+		CommentTemplate:    flags.Comment,
+		MissUpdateOnList:   flags.OnMiss > 0,
+		MaxStale:           flags.Stale,
+		Cache:              cache,
+		CacheKey:           cacheKey,
+		CacheMaxAge:        flags.MaxAge,
+		UpdateConcurrency:  flags.Workers,
 	})
-	if err := srv.Update(env.Context()); err != nil {
-		return fmt.Errorf("initialize agent: %w", err)
+	if err != nil {
+		return fmt.Errorf("create agent: %w", err)
+	}
+	if res, err := srv.Update(env.Context()); err != nil {
+		// A partial update is good enough, unless it has no keys for some
+		// secrets that the cache may have.
+		partial := res != nil && !flags.Atomic
+		if partial && (len(res.Missing) == 0 || cache == nil) {
+			log.Printf("WARNING: Some keys could not be loaded: %v", err)
+		} else if cache == nil {
+			return fmt.Errorf("initialize agent: %w", err)
+		} else if cerr := srv.LoadCache(); cerr == nil {
+			log.Printf("WARNING: Initial update failed, using cached keys: %v", err)
+		} else if partial {
+			log.Printf("WARNING: Some keys could not be loaded: %v (cache: %v)", err, cerr)
+		} else {
+			return fmt.Errorf("initialize agent: %w (cache: %v)", err, cerr)
+		}
 	}
+	var g taskgroup.Group
 	if flags.Update > 0 {
-		go func() {
-			for range time.NewTicker(flags.Update).C {
-				if err := srv.Update(env.Context()); err != nil {
-					log.Printf("WARNING: Update failed: %v", err)
-				}
-			}
-		}()
+		g.Go(func() error {
+			return srv.Run(env.Context(), tskagent.UpdatePolicy{Interval: flags.Update})
+		})
 		log.Printf("Enabled periodic updates (%v)", flags.Update)
 	}
 	srv.Serve(env.Context(), lst)
+	return g.Wait()
+}
+
+// parseIDs parses a comma-separated list of numeric user or group IDs.
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+	for _, f := range splitList(s) {
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadOrCreateKey reads a cache key from the specified file, creating the
+// file with a new random key if it does not exist. The directory of the file
+// is created if necessary, accessible only to the current user.
+func loadOrCreateKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, tskagent.CacheKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		return key, os.WriteFile(path, key, 0600)
+	} else if err != nil {
+		return nil, err
+	} else if len(key) != tskagent.CacheKeyLen {
+		return nil, fmt.Errorf("key file %q has %d bytes, want %d", path, len(key), tskagent.CacheKeyLen)
+	}
+	return key, nil
+}
+
+// runValidate checks the key secret values stored in the specified files, and
+// reports the problems it finds in each. A file named "-" is read from stdin.
+// It reports an error if any of the files is invalid.
+func runValidate(env *command.Env, files ...string) error {
+	if len(files) == 0 {
+		return env.Usagef("at least one file is required")
+	}
+	var nbad int
+	for _, file := range files {
+		var data []byte
+		var err error
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err == nil {
+			err = tskagent.CheckKeySecret(data)
+		}
+		if err != nil {
+			nbad++
+			for line := range strings.Lines(err.Error()) {
+				fmt.Printf("%s: %s", file, line)
+			}
+			fmt.Println()
+		} else {
+			fmt.Printf("%s: ok\n", file)
+		}
+	}
+	if nbad != 0 {
+		return fmt.Errorf("%d of %d files are invalid", nbad, len(files))
+	}
 	return nil
 }
+
+// splitList splits a comma-separated list, discarding empty elements.
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
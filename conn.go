@@ -0,0 +1,240 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A conn is the view of a [Server] presented to a single client connection.
+// It delegates to the server, but tracks state specific to the connection,
+// such as the sessions to which the client has bound it.
+type conn struct {
+	s    *Server
+	peer *Peer // if nil, the peer is unknown
+
+	μ     sync.Mutex
+	binds []sessionBind
+}
+
+// A sessionBind records a session-bind@openssh.com request on a connection.
+type sessionBind struct {
+	HostKey    ssh.PublicKey // the host key of the server
+	SessionID  []byte        // the session identifier
+	Forwarding bool          // whether the connection is being forwarded
+}
+
+const (
+	// sessionBindExtension is the name of the OpenSSH extension by which
+	// clients bind an agent connection to an SSH session.
+	sessionBindExtension = "session-bind@openssh.com"
+
+	// maxSessionBinds is the maximum number of session bindings accepted on a
+	// single connection, as in OpenSSH.
+	maxSessionBinds = 16
+)
+
+// bindings returns a copy of the session bindings for c. It is safe to call
+// with c == nil, which represents a connection with no bindings.
+func (c *conn) bindings() []sessionBind {
+	if c == nil {
+		return nil
+	}
+	c.μ.Lock()
+	defer c.μ.Unlock()
+	return slices.Clone(c.binds)
+}
+
+// peerInfo returns the peer of c, or nil if c == nil or its peer is unknown.
+func (c *conn) peerInfo() *Peer {
+	if c == nil {
+		return nil
+	}
+	return c.peer
+}
+
+// List implements part of the [agent.Agent] interface.
+//
+// Only keys that the policy permits the peer to use on c are listed.
+func (c *conn) List() ([]*agent.Key, error) { return c.s.list(c) }
+
+// Sign implements part of the [agent.Agent] interface.
+func (c *conn) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.s.sign(c, key, data, 0)
+}
+
+// SignWithFlags implements part of the [agent.ExtendedAgent] interface.
+func (c *conn) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return c.s.sign(c, key, data, flags)
+}
+
+// Add implements part of the [agent.Agent] interface.
+func (c *conn) Add(key agent.AddedKey) error { return c.s.Add(key) }
+
+// Remove implements part of the [agent.Agent] interface.
+func (c *conn) Remove(key ssh.PublicKey) error { return c.s.Remove(key) }
+
+// RemoveAll implements part of the [agent.Agent] interface.
+func (c *conn) RemoveAll() error { return c.s.RemoveAll() }
+
+// Lock implements part of the [agent.Agent] interface.
+func (c *conn) Lock(passphrase []byte) error { return c.s.Lock(passphrase) }
+
+// Unlock implements part of the [agent.Agent] interface.
+func (c *conn) Unlock(passphrase []byte) error { return c.s.Unlock(passphrase) }
+
+// Signers implements part of the [agent.Agent] interface.
+func (c *conn) Signers() ([]ssh.Signer, error) { return c.s.Signers() }
+
+// Extension implements part of the [agent.ExtendedAgent] interface.
+// In addition to the extensions supported by the server, a connection
+// supports the session-bind@openssh.com extension.
+func (c *conn) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != sessionBindExtension {
+		return c.s.Extension(extensionType, contents)
+	} else if c.s.isLocked() {
+		return nil, errLocked
+	}
+	return nil, c.bindSession(contents)
+}
+
+// bindSession handles a session-bind@openssh.com request with the specified
+// contents, as described in PROTOCOL.agent in OpenSSH.
+func (c *conn) bindSession(contents []byte) error {
+	sc := newScanner(contents)
+	hostKeyBlob, err := sc.scanString()
+	if err != nil {
+		return fmt.Errorf("agent: session-bind host key: %w", err)
+	}
+	sid, err := sc.scanString()
+	if err != nil {
+		return fmt.Errorf("agent: session-bind session ID: %w", err)
+	}
+	sigBlob, err := sc.scanString()
+	if err != nil {
+		return fmt.Errorf("agent: session-bind signature: %w", err)
+	}
+	fwd, err := sc.scanByte()
+	if err != nil {
+		return fmt.Errorf("agent: session-bind forwarding flag: %w", err)
+	} else if !sc.atEOF() {
+		return errors.New("agent: extra data after session-bind request")
+	}
+
+	hostKey, err := ssh.ParsePublicKey(hostKeyBlob)
+	if err != nil {
+		return fmt.Errorf("agent: session-bind host key: %w", err)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(sigBlob, &sig); err != nil {
+		return fmt.Errorf("agent: session-bind signature: %w", err)
+	}
+	if err := hostKey.Verify(sid, &sig); err != nil {
+		return fmt.Errorf("agent: invalid session-bind signature: %w", err)
+	}
+
+	c.μ.Lock()
+	defer c.μ.Unlock()
+	bind := sessionBind{HostKey: hostKey, SessionID: bytes.Clone(sid), Forwarding: fwd != 0}
+	if n := len(c.binds); n != 0 {
+		last := c.binds[n-1]
+		if bytes.Equal(last.SessionID, bind.SessionID) {
+			if !bytes.Equal(last.HostKey.Marshal(), hostKeyBlob) {
+				return errors.New("agent: session-bind host key mismatch")
+			}
+			return nil // repeated binding of the same session
+		} else if !last.Forwarding {
+			return errors.New("agent: connection is already bound to a session")
+		} else if n >= maxSessionBinds {
+			return errors.New("agent: too many session bindings")
+		}
+	}
+	c.binds = append(c.binds, bind)
+	c.s.logPrintf("Connection bound to host key %s (forwarding=%v)",
+		ssh.FingerprintSHA256(hostKey), bind.Forwarding)
+	return nil
+}
+
+// checkDestination reports an error if the policy p, which may be nil, does
+// not permit the use of a key on a connection with the given session
+// bindings. If rec != nil, it describes the data to be signed; otherwise the
+// check is for listing keys.
+//
+// As in OpenSSH, a connection with no bindings is considered local use, and
+// all keys may be used on it, except that a key with destination
+// restrictions may not sign a userauth request.
+func (s *Server) checkDestination(p *KeyPolicy, binds []sessionBind, rec *SignRecord) error {
+	userAuth := rec != nil && rec.Kind == DataUserAuth
+	if p == nil || (len(binds) == 0 && !userAuth) {
+		return nil // no restrictions, or local use
+	}
+	if p.NoForwarding && slices.ContainsFunc(binds, func(b sessionBind) bool { return b.Forwarding }) {
+		return errors.New("agent: key may not be used over a forwarded connection")
+	}
+	if len(p.Hosts) == 0 && len(p.HostKeys) == 0 {
+		return nil // no destination restrictions
+	} else if len(binds) == 0 {
+		return errors.New("agent: destination-restricted key may not authenticate on an unbound connection")
+	}
+	dest := binds[len(binds)-1]
+	if userAuth && !bytes.Equal(rec.SessionID, dest.SessionID) {
+		return errors.New("agent: userauth request does not match the bound session")
+	}
+	if !s.hostPermitted(p, dest.HostKey) {
+		return fmt.Errorf("agent: key may not be used for host key %s", ssh.FingerprintSHA256(dest.HostKey))
+	}
+	return nil
+}
+
+// checkFingerprint reports an error if fp is not a SHA256 key fingerprint in
+// the format of [ssh.FingerprintSHA256].
+func checkFingerprint(fp string) error {
+	b64, ok := strings.CutPrefix(fp, "SHA256:")
+	if !ok {
+		return fmt.Errorf("invalid host key fingerprint %q", fp)
+	}
+	if hash, err := base64.RawStdEncoding.DecodeString(b64); err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid host key fingerprint %q", fp)
+	}
+	return nil
+}
+
+// hostPermitted reports whether p permits authentication to a host with the
+// given host key.
+func (s *Server) hostPermitted(p *KeyPolicy, hostKey ssh.PublicKey) bool {
+	if slices.Contains(p.HostKeys, ssh.FingerprintSHA256(hostKey)) {
+		return true
+	} else if len(p.Hosts) == 0 || len(s.knownHosts) == 0 {
+		return false
+	}
+	check, err := knownhosts.New(s.knownHosts...)
+	if err != nil {
+		s.logPrintf("WARNING: reading known hosts: %v", err)
+		return false
+	}
+	// The address is required, but not used since we always give a hostname.
+	remote := &net.TCPAddr{IP: net.IPv4zero, Port: 22}
+	for _, host := range p.Hosts {
+		addr := host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			addr = net.JoinHostPort(host, "22")
+		}
+		if check(addr, remote, hostKey) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An Envelope is the JSON form of a key secret, for keys with settings of
+// their own. The value of a key secret may be either an Envelope, or a bare
+// private key in PEM format, or a bundle of several keys (see
+// [CheckKeySecret]).
+type Envelope struct {
+	// Version is the version of the envelope format. It must be 1.
+	Version int
+
+	// Key is the private key, in PEM format. If the key is encrypted, its
+	// passphrase must be stored in a separate secret, as for a bare key.
+	Key string
+
+	// Passphrase, if set, is the name of the secret holding the passphrase
+	// for Key, which must be encrypted. By default, the passphrase is in the
+	// secret named by the key secret plus ".passphrase". The keys in a bundle
+	// share one passphrase secret.
+	Passphrase string `json:",omitempty"`
+
+	// Cert, if set, is an OpenSSH certificate for the key, in authorized_keys
+	// format. A certificate stored in a separate secret takes precedence.
+	Cert string `json:",omitempty"`
+
+	// Comment, if set, overrides the comment stored with the key. The comment
+	// of an encrypted key is lost when it is decrypted, so this is the way to
+	// give an encrypted key a comment (see also Config.CommentTemplate).
+	Comment string `json:",omitempty"`
+
+	// NotBefore and NotAfter, if set, limit the period during which the agent
+	// offers the key.
+	NotBefore time.Time `json:",omitzero"`
+	NotAfter  time.Time `json:",omitzero"`
+
+	// HostKeys and Hosts, if set, restrict the destinations to which the key
+	// may authenticate, as the fields of the same names in a [KeyPolicy].
+	// They apply in addition to any policy for the key in the [Config].
+	HostKeys []string `json:",omitempty"`
+	Hosts    []string `json:",omitempty"`
+
+	// Confirm, if true, requires each use of the key to be confirmed, as for
+	// KeyPolicy.Confirm.
+	Confirm bool `json:",omitempty"`
+
+	// Priority orders the keys listed by the agent: Keys with a higher
+	// priority are listed first, and so are tried first by most clients.
+	Priority int `json:",omitempty"`
+
+	// Labels are arbitrary metadata for the key. They are included in the
+	// audit record of each signature made with the key.
+	Labels map[string]string `json:",omitempty"`
+}
+
+// envelopeVersion is the supported version of the envelope format.
+const envelopeVersion = 1
+
+// isEnvelope reports whether data appears to be an Envelope, rather than a
+// bare PEM key.
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// parseEnvelope parses and validates an Envelope from data.
+func parseEnvelope(data []byte) (*Envelope, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var env Envelope
+	if err := dec.Decode(&env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	} else if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid envelope: extra data after object")
+	}
+	if err := env.check(); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// check reports all the problems with the contents of e, or nil if there are
+// none. If the key is encrypted, its contents are not checked.
+func (e *Envelope) check() error {
+	var errs []error
+	if e.Version != envelopeVersion {
+		errs = append(errs, fmt.Errorf("unsupported envelope version %d", e.Version))
+	}
+	var pub ssh.PublicKey
+	if e.Key == "" {
+		errs = append(errs, errors.New("missing private key"))
+	} else if signer, err := ssh.ParsePrivateKey([]byte(e.Key)); err == nil {
+		pub = signer.PublicKey()
+		if e.Passphrase != "" {
+			errs = append(errs, errors.New("passphrase secret is set, but the key is not encrypted"))
+		}
+	} else if !isPassphraseMissing(err) {
+		errs = append(errs, fmt.Errorf("invalid private key: %w", err))
+	}
+	if e.Cert != "" {
+		if cert, err := parseCertOnly([]byte(e.Cert)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid certificate: %w", err))
+		} else if pub != nil && !bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+			errs = append(errs, errors.New("certificate does not match the key"))
+		}
+	}
+	if !e.NotBefore.IsZero() && !e.NotAfter.IsZero() && !e.NotBefore.Before(e.NotAfter) {
+		errs = append(errs, errors.New("NotBefore is not before NotAfter"))
+	}
+	for _, fp := range e.HostKeys {
+		if err := checkFingerprint(fp); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, host := range e.Hosts {
+		if host == "" {
+			errs = append(errs, errors.New("empty host name"))
+		}
+	}
+	for label := range e.Labels {
+		if label == "" {
+			errs = append(errs, errors.New("empty label name"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// apply applies the settings of e to key, which was parsed from e.
+func (e *Envelope) apply(key *sshKey) error {
+	if e.Comment != "" {
+		key.Comment = e.Comment
+	}
+	if e.Cert != "" {
+		cert, err := parseCertOnly([]byte(e.Cert))
+		if err != nil {
+			return err
+		} else if !bytes.Equal(cert.Key.Marshal(), key.Signer.PublicKey().Marshal()) {
+			return errors.New("certificate does not match the key")
+		}
+		key.Cert = cert
+	}
+	key.PassName = e.Passphrase
+	key.NotBefore, key.Expires = e.NotBefore, e.NotAfter
+	key.Confirm = e.Confirm
+	key.Priority, key.Labels = e.Priority, e.Labels
+	if len(e.HostKeys) != 0 || len(e.Hosts) != 0 {
+		key.Limits = &KeyPolicy{Match: key.Name, HostKeys: e.HostKeys, Hosts: e.Hosts}
+	}
+	return nil
+}
+
+// CheckKeySecret reports whether data is a valid value for a key secret:
+// Either an [Envelope], or a private key in PEM format, or a bundle of
+// several keys, given as a JSON array of envelopes or as concatenated PEM
+// blocks. The error reports all the problems found. An encrypted key is
+// accepted, but its contents are not checked, since the passphrase is stored
+// separately.
+func CheckKeySecret(data []byte) error {
+	parts, err := splitBundle(data)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, part := range parts {
+		if err := checkKey(part); err != nil && len(parts) > 1 {
+			errs = append(errs, fmt.Errorf("key %d of %d: %w", i+1, len(parts), err))
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkKey reports whether data is a valid value for a single key.
+func checkKey(data []byte) error {
+	if isEnvelope(data) {
+		_, err := parseEnvelope(data)
+		return err
+	}
+	if _, err := ssh.ParsePrivateKey(data); err != nil && !isPassphraseMissing(err) {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	return nil
+}
+
+// passphraseName returns the name of the passphrase secret named by the
+// envelopes in the value of a key secret, or "" if they name none.
+func passphraseName(data []byte) string {
+	parts, err := splitBundle(data)
+	if err != nil {
+		return ""
+	}
+	for _, part := range parts {
+		var env struct{ Passphrase string }
+		if isEnvelope(part) && json.Unmarshal(part, &env) == nil && env.Passphrase != "" {
+			return env.Passphrase
+		}
+	}
+	return ""
+}
+
+// isPassphraseMissing reports whether err indicates that a key could not be
+// parsed because it is encrypted.
+func isPassphraseMissing(err error) bool {
+	var pmErr *ssh.PassphraseMissingError
+	return errors.As(err, &pmErr)
+}
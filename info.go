@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// A KeyInfo describes a key offered by the agent.
+type KeyInfo struct {
+	Secret      string            // the secret name; "" for added keys
+	Version     api.SecretVersion // the secret version; 0 for added keys
+	Fingerprint string            // the SHA256 fingerprint of the key
+	Type        string            // the key type, e.g., "ssh-ed25519"
+	Comment     string            // the comment offered to clients
+	Certificate bool              // whether a valid certificate is offered
+	Superseded  bool              // whether the key is in its rotation grace period
+	Expires     time.Time         // if non-zero, when the key expires
+	Labels      map[string]string // labels from the key envelope, if any
+}
+
+// Keys reports the keys currently offered by the agent, in the order in which
+// they are listed to clients. Unlike the comments offered to clients, which
+// may be set by the key or by Config.CommentTemplate, the Secret and Version
+// fields always identify where each key came from. Keys reports no keys while
+// the agent is locked.
+func (s *Server) Keys() []KeyInfo {
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	if s.locked {
+		return nil
+	}
+	now := time.Now()
+	var out []KeyInfo
+	for id, sk := range s.eachKeyLocked(now) {
+		pub := sk.Signer.PublicKey()
+		out = append(out, KeyInfo{
+			Secret:      sk.Name,
+			Version:     sk.Version,
+			Fingerprint: ssh.FingerprintSHA256(pub),
+			Type:        pub.Type(),
+			Comment:     sk.Comment,
+			Certificate: sk.certValid(now),
+			Superseded:  s.previous[id] == sk,
+			Expires:     sk.Expires,
+			Labels:      maps.Clone(sk.Labels),
+		})
+	}
+	return out
+}
+
+// commentFields are the fields that may be used in a comment template, mapped
+// to functions that return their values for a key.
+var commentFields = map[string]func(*sshKey) string{
+	"name":        func(sk *sshKey) string { return sk.Name },
+	"basename":    func(sk *sshKey) string { return path.Base(sk.Name) },
+	"version":     func(sk *sshKey) string { return strconv.Itoa(int(sk.Version)) },
+	"comment":     func(sk *sshKey) string { return sk.Comment },
+	"fingerprint": func(sk *sshKey) string { return ssh.FingerprintSHA256(sk.Signer.PublicKey()) },
+}
+
+// checkCommentTemplate reports an error if tmpl refers to a field that is not
+// in commentFields, or has an unterminated field. Every "{" begins a field, so
+// a template cannot contain a literal "{".
+func checkCommentTemplate(tmpl string) error {
+	for rest := tmpl; ; {
+		_, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			return nil
+		}
+		field, tail, ok := strings.Cut(after, "}")
+		if !ok {
+			return fmt.Errorf("invalid comment template %q: unterminated field", tmpl)
+		} else if _, ok := commentFields[field]; !ok {
+			return fmt.Errorf("invalid comment template %q: unknown field {%s}", tmpl, field)
+		}
+		rest = tail
+	}
+}
+
+// applyComment sets the comment of key from the comment template, if there is
+// one. Unless the template refers to {comment}, it applies only to keys that
+// have no comment of their own.
+func (s *Server) applyComment(key *sshKey) {
+	if s.commentTmpl == "" {
+		return
+	} else if key.Comment != "" && !strings.Contains(s.commentTmpl, "{comment}") {
+		return
+	}
+	var args []string
+	for field, value := range commentFields {
+		args = append(args, "{"+field+"}", value(key))
+	}
+	key.Comment = strings.TrimSpace(strings.NewReplacer(args...).Replace(s.commentTmpl))
+}
@@ -4,18 +4,37 @@
 package tskagent
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+
+	_ "embed"
 )
 
-var _ agent.Agent = &Server{}
+// testDSAKey is a DSA key in the OpenSSL PEM format, which is the only format
+// in which ssh.ParsePrivateKey accepts DSA keys.
+//
+//go:embed testdata/test-dsa.key
+var testDSAKey []byte
+
+var _ agent.ExtendedAgent = &Server{}
 
 func TestKeyParse(t *testing.T) {
 	tests := []struct {
@@ -51,7 +70,7 @@ func TestKeyParse(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			key, err := parseStoredKey(tc.name, 1, tc.input)
+			key, err := parseStoredKey(tc.name, 1, tc.input, nil)
 			if err != nil {
 				t.Fatalf("parsing stored key: %v", err)
 			}
@@ -65,6 +84,224 @@ func TestKeyParse(t *testing.T) {
 	}
 }
 
+func TestSignWithFlags(t *testing.T) {
+	const testData = "fee fie foe fum"
+	keys := []struct {
+		name    string
+		input   []byte
+		keyType string
+	}{
+		{"ED25519/OpenSSH", mustGenerateKey(t, genED25519, ""), ssh.KeyAlgoED25519},
+		{"ED25519/PKCS8", mustGeneratePKCS8(t, genED25519), ssh.KeyAlgoED25519},
+		{"RSA/OpenSSH", mustGenerateKey(t, genRSA, ""), ssh.KeyAlgoRSA},
+		{"RSA/PKCS1", mustGeneratePKCS1(t), ssh.KeyAlgoRSA},
+		{"RSA/PKCS8", mustGeneratePKCS8(t, genRSA), ssh.KeyAlgoRSA},
+		{"ECDSA256/OpenSSH", mustGenerateKey(t, genECDSA(elliptic.P256()), ""), ssh.KeyAlgoECDSA256},
+		{"ECDSA384/OpenSSH", mustGenerateKey(t, genECDSA(elliptic.P384()), ""), ssh.KeyAlgoECDSA384},
+		{"ECDSA521/OpenSSH", mustGenerateKey(t, genECDSA(elliptic.P521()), ""), ssh.KeyAlgoECDSA521},
+		{"ECDSA256/SEC1", mustGenerateSEC1(t, elliptic.P256()), ssh.KeyAlgoECDSA256},
+		{"ECDSA256/PKCS8", mustGeneratePKCS8(t, genECDSA(elliptic.P256())), ssh.KeyAlgoECDSA256},
+		{"DSA", testDSAKey, "ssh-dss"},
+	}
+	flags := []struct {
+		name  string
+		flags agent.SignatureFlags
+		rsa   string // the expected signature format for RSA keys
+	}{
+		{"Default", 0, ssh.KeyAlgoRSA},
+		{"SHA256", agent.SignatureFlagRsaSha256, ssh.KeyAlgoRSASHA256},
+		{"SHA512", agent.SignatureFlagRsaSha512, ssh.KeyAlgoRSASHA512},
+	}
+	for _, kc := range keys {
+		key, err := parseStoredKey(kc.name, 1, kc.input, nil)
+		if err != nil {
+			t.Fatalf("Parse %s key: %v", kc.name, err)
+		}
+		pub := key.Signer.PublicKey()
+		if got := pub.Type(); got != kc.keyType {
+			t.Fatalf("Key type: got %q, want %q", got, kc.keyType)
+		}
+		s := &Server{keys: map[string]*sshKey{key.mapID(): key}}
+
+		for _, fc := range flags {
+			t.Run(kc.name+"/"+fc.name, func(t *testing.T) {
+				sig, err := s.SignWithFlags(pub, []byte(testData), fc.flags)
+				if err != nil {
+					t.Fatalf("SignWithFlags: unexpected error: %v", err)
+				}
+				want := kc.keyType
+				if want == ssh.KeyAlgoRSA {
+					want = fc.rsa
+				}
+				if sig.Format != want {
+					t.Errorf("Signature format: got %q, want %q", sig.Format, want)
+				}
+				if err := pub.Verify([]byte(testData), sig); err != nil {
+					t.Errorf("Verify signature: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestLockDiscardsKeys(t *testing.T) {
+	const passphrase = "open sesame"
+	key, err := parseStoredKey("test", 1, mustGenerateKey(t, genED25519, ""), nil)
+	if err != nil {
+		t.Fatalf("Parse key: %v", err)
+	}
+	s := &Server{keys: map[string]*sshKey{key.mapID(): key}}
+	if err := s.Lock([]byte(passphrase)); err != nil {
+		t.Fatalf("Lock: unexpected error: %v", err)
+	}
+	if len(s.keys) != 0 {
+		t.Errorf("Locked agent has %d keys, want 0", len(s.keys))
+	}
+	if lst, err := s.Signers(); err == nil {
+		t.Errorf("Signers while locked: got %+v, want error", lst)
+	}
+	if bytes.Contains(s.lockHash, []byte(passphrase)) {
+		t.Error("Lock hash contains the plaintext passphrase")
+	}
+	if err := s.Unlock([]byte("wrong")); err == nil {
+		t.Error("Unlock with wrong passphrase: did not get expected error")
+	}
+	if err := s.Unlock([]byte(passphrase)); err != nil {
+		t.Errorf("Unlock: unexpected error: %v", err)
+	}
+	if s.lockSalt != nil || s.lockHash != nil {
+		t.Error("Unlocked agent retains lock state")
+	}
+}
+
+func TestParseSignData(t *testing.T) {
+	type userAuth struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algorithm string
+		PubKey    []byte
+	}
+	type sshSig struct {
+		Namespace string
+		Reserved  string
+		Hash      string
+		Digest    []byte
+	}
+	basic := userAuth{
+		SessionID: []byte("session"),
+		Type:      userAuthRequest,
+		User:      "alice",
+		Service:   "ssh-connection",
+		Method:    "publickey",
+		HasSig:    true,
+		Algorithm: "ssh-ed25519",
+		PubKey:    []byte("pubkey"),
+	}
+	bound := basic
+	bound.Method = "publickey-hostbound-v00@openssh.com"
+	noSig := basic
+	noSig.HasSig = false
+	password := basic
+	password.Method = "password"
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  SignRecord
+	}{
+		{"Empty", nil, SignRecord{Kind: DataUnknown}},
+		{"Garbage", []byte("boo likes forests"), SignRecord{Kind: DataUnknown}},
+		{"UserAuth", ssh.Marshal(basic), SignRecord{
+			Kind:      DataUserAuth,
+			SessionID: []byte("session"),
+			User:      "alice",
+			Service:   "ssh-connection",
+			Algorithm: "ssh-ed25519",
+		}},
+		{"UserAuth/HostBound", append(ssh.Marshal(bound), ssh.Marshal(struct{ HostKey []byte }{[]byte("hostkey")})...), SignRecord{
+			Kind:      DataUserAuth,
+			SessionID: []byte("session"),
+			User:      "alice",
+			Service:   "ssh-connection",
+			Algorithm: "ssh-ed25519",
+			HostKey:   []byte("hostkey"),
+		}},
+		{"UserAuth/NoSig", ssh.Marshal(noSig), SignRecord{Kind: DataUnknown}},
+		{"UserAuth/Password", ssh.Marshal(password), SignRecord{Kind: DataUnknown}},
+		{"UserAuth/Trailing", append(ssh.Marshal(basic), 0), SignRecord{Kind: DataUnknown}},
+		{"UserAuth/Truncated", ssh.Marshal(basic)[:20], SignRecord{Kind: DataUnknown}},
+		{"SSHSig", append([]byte("SSHSIG"), ssh.Marshal(sshSig{"git", "", "sha512", []byte("digest")})...), SignRecord{
+			Kind:          DataSSHSig,
+			Namespace:     "git",
+			HashAlgorithm: "sha512",
+		}},
+		{"SSHSig/Truncated", []byte("SSHSIG\x00\x00\x00\x03git"), SignRecord{Kind: DataUnknown}},
+	}
+	key, err := parseStoredKey("test", 1, mustGenerateKey(t, genED25519, ""), nil)
+	if err != nil {
+		t.Fatalf("Parse key: %v", err)
+	}
+	ignore := cmpopts.IgnoreFields(SignRecord{}, "Time", "Secret", "Version", "Fingerprint", "Comment")
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := newSignRecord(key, tc.input)
+			if diff := cmp.Diff(got, tc.want, ignore, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Wrong record (-got, +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Process inspection is not supported on %s", runtime.GOOS)
+	}
+	want, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+	if got, err := processExe(os.Getpid()); err != nil || got != want {
+		t.Errorf("processExe: got %q, %v; want %q", got, err, want)
+	}
+	if got, err := parentPID(os.Getpid()); err != nil || got != os.Getppid() {
+		t.Errorf("parentPID: got %d, %v; want %d", got, err, os.Getppid())
+	}
+}
+
+func TestUpdatePolicyDelay(t *testing.T) {
+	p := UpdatePolicy{
+		Interval:      time.Minute,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 10 * time.Second,
+	}.withDefaults()
+	for failures, want := range []time.Duration{
+		time.Minute, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second,
+	} {
+		if got := p.delay(failures); got != want {
+			t.Errorf("delay(%d): got %v, want %v", failures, got, want)
+		}
+	}
+	if got := p.delay(1000); got != p.MaxRetryDelay {
+		t.Errorf("delay(1000): got %v, want %v", got, p.MaxRetryDelay)
+	}
+
+	for range 100 {
+		got := p.jitter(time.Minute)
+		if got < 54*time.Second || got > 66*time.Second {
+			t.Errorf("jitter(1m): got %v, want 54s..66s", got)
+		}
+	}
+	p.Jitter = -1
+	if got := p.jitter(time.Minute); got != time.Minute {
+		t.Errorf("jitter(1m) without jitter: got %v, want 1m", got)
+	}
+}
+
 func mustGenerateKey(t *testing.T, gen func() (crypto.PrivateKey, error), comment string) []byte {
 	t.Helper()
 	key, err := gen()
@@ -86,3 +323,327 @@ func genED25519() (crypto.PrivateKey, error) {
 func genRSA() (crypto.PrivateKey, error) {
 	return rsa.GenerateKey(crand.Reader, 1024)
 }
+
+func genECDSA(curve elliptic.Curve) func() (crypto.PrivateKey, error) {
+	return func() (crypto.PrivateKey, error) { return ecdsa.GenerateKey(curve, crand.Reader) }
+}
+
+func mustGeneratePKCS1(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(crand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Generating key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func mustGeneratePKCS8(t *testing.T, gen func() (crypto.PrivateKey, error)) []byte {
+	t.Helper()
+	key, err := gen()
+	if err != nil {
+		t.Fatalf("Generating key: %v", err)
+	}
+	enc, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Marshaling key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: enc})
+}
+
+func mustGenerateSEC1(t *testing.T, curve elliptic.Curve) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, crand.Reader)
+	if err != nil {
+		t.Fatalf("Generating key: %v", err)
+	}
+	enc, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Marshaling key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: enc})
+}
+
+func TestSelected(t *testing.T) {
+	tests := []struct {
+		include, exclude []string
+		prefix           string
+		maxDepth         int
+		name             string
+		want             bool
+	}{
+		{prefix: "a/b", name: "a/b/c", want: true},
+		{prefix: "a/b/", name: "a/b/c/d", want: true},
+		{prefix: "a/b", name: "a/bc", want: false},
+		{prefix: "a/b", name: "a/b", want: false},
+		{prefix: "a/*", name: "a/x/c", want: false},
+		{prefix: "a/*", name: "a/*/c", want: true},
+		{prefix: "a/b", maxDepth: 1, name: "a/b/c/d", want: false},
+		{prefix: "a/b", maxDepth: 2, name: "a/b/c/d", want: true},
+
+		{include: []string{"prod/*/ssh-keys/*"}, name: "prod/web/ssh-keys/deploy", want: true},
+		{include: []string{"prod/*/ssh-keys/*"}, name: "prod/web/ssh-keys/ci/deploy", want: false},
+		{include: []string{"prod/*/ssh-keys/*"}, name: "prod/web/ssh-keys/deploy-cert.pub", want: true},
+		{include: []string{"prod/*/ssh-keys/"}, name: "prod/web/ssh-keys/ci/deploy", want: true},
+		{include: []string{"prod/*/ssh-keys/"}, maxDepth: 1, name: "prod/web/ssh-keys/ci/deploy", want: false},
+		{include: []string{"prod/web/deploy"}, name: "prod/web/deploy-cert.pub", want: true},
+		{include: []string{"x/", "prod/*/ssh-keys/"}, name: "prod/db/ssh-keys/k", want: true},
+
+		{include: []string{"prod/"}, exclude: []string{"prod/secret/"}, name: "prod/secret/k", want: false},
+		{include: []string{"prod/"}, exclude: []string{"prod/secret/"}, name: "prod/public/k", want: true},
+		{include: []string{"prod/"}, exclude: []string{"prod/*/root"}, name: "prod/web/root", want: false},
+		{include: []string{"prod/"}, exclude: []string{"prod/*/root"}, name: "prod/web/root-cert.pub", want: false},
+		{include: []string{"prod/"}, maxDepth: 1, exclude: []string{"prod/a/"}, name: "prod/a/b/c", want: false},
+	}
+	for _, tc := range tests {
+		include, err := parsePatterns(tc.include)
+		if err != nil {
+			t.Fatalf("Parse %q: %v", tc.include, err)
+		}
+		if tc.prefix != "" {
+			include = append(include, prefixPattern(tc.prefix))
+		}
+		exclude, err := parsePatterns(tc.exclude)
+		if err != nil {
+			t.Fatalf("Parse %q: %v", tc.exclude, err)
+		}
+		s := &Server{include: include, exclude: exclude, maxDepth: tc.maxDepth}
+		if got := s.selected(tc.name); got != tc.want {
+			t.Errorf("Include %q prefix %q exclude %q depth %d: selected(%q) = %v, want %v",
+				tc.include, tc.prefix, tc.exclude, tc.maxDepth, tc.name, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"", "/", "a/[b"} {
+		if _, err := parsePatterns([]string{bad}); err == nil {
+			t.Errorf("Parse %q: got nil, want error", bad)
+		}
+	}
+}
+
+func TestParseKeyFile(t *testing.T) {
+	seeds := []string{
+		"00000000000000000000000000000001",
+		"00000000000000000000000000000002",
+	}
+	var pubs, privs [][]byte
+	for _, seed := range seeds {
+		key := ed25519.NewKeyFromSeed([]byte(seed))
+		pub := key.Public().(ed25519.PublicKey)
+		pubs = append(pubs, keyBlob("ssh-ed25519", pub))
+		privs = append(privs, keyBlob("ssh-ed25519", pub, key))
+	}
+	// privateSection returns the private section of a key file with the
+	// given check integers, keys, and comments, padded to a multiple of 8.
+	privateSection := func(check1, check2 uint32, keys [][]byte, comments ...string) []byte {
+		buf := binary.BigEndian.AppendUint32(nil, check1)
+		buf = binary.BigEndian.AppendUint32(buf, check2)
+		for i, key := range keys {
+			buf = append(buf, key...)
+			buf = appendString(buf, []byte(comments[i]))
+		}
+		for i := byte(1); len(buf)%8 != 0; i++ {
+			buf = append(buf, i)
+		}
+		return buf
+	}
+	multi := keyFileBlob("none", "none", nil, pubs, privateSection(1, 1, privs, "first", "second"))
+
+	t.Run("Generated", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			gen     func() (crypto.PrivateKey, error)
+			keyType string
+		}{
+			{"ED25519", genED25519, "ssh-ed25519"},
+			{"RSA", genRSA, "ssh-rsa"},
+			{"ECDSA-P256", genECDSA(elliptic.P256()), "ecdsa-sha2-nistp256"},
+			{"ECDSA-P384", genECDSA(elliptic.P384()), "ecdsa-sha2-nistp384"},
+			{"ECDSA-P521", genECDSA(elliptic.P521()), "ecdsa-sha2-nistp521"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				blk, _ := pem.Decode(mustGenerateKey(t, tc.gen, "comment for "+tc.name))
+				kf, err := parseKeyFile(blk.Bytes)
+				if err != nil {
+					t.Fatalf("parseKeyFile: unexpected error: %v", err)
+				}
+				if kf.Cipher != "none" || kf.KDF != "none" {
+					t.Errorf("Cipher, KDF: got %q, %q, want none, none", kf.Cipher, kf.KDF)
+				}
+				if len(kf.PublicKeys) != 1 || len(kf.Keys) != 1 {
+					t.Fatalf("Got %d public and %d private keys, want 1 each", len(kf.PublicKeys), len(kf.Keys))
+				}
+				if got := kf.Keys[0].Type; got != tc.keyType {
+					t.Errorf("Type: got %q, want %q", got, tc.keyType)
+				}
+				if got, want := kf.Keys[0].Comment, "comment for "+tc.name; got != want {
+					t.Errorf("Comment: got %q, want %q", got, want)
+				}
+			})
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		key := ed25519.NewKeyFromSeed([]byte(seeds[0]))
+		blk, err := ssh.MarshalPrivateKeyWithPassphrase(key, "secret", []byte("hunter2"))
+		if err != nil {
+			t.Fatalf("Marshal key: %v", err)
+		}
+		kf, err := parseKeyFile(blk.Bytes)
+		if err != nil {
+			t.Fatalf("parseKeyFile: unexpected error: %v", err)
+		}
+		if kf.Cipher != "aes256-ctr" || kf.KDF != "bcrypt" {
+			t.Errorf("Cipher, KDF: got %q, %q, want aes256-ctr, bcrypt", kf.Cipher, kf.KDF)
+		}
+		if len(kf.Salt) == 0 || kf.Rounds == 0 {
+			t.Errorf("KDF options: got salt %x, rounds %d, want non-empty", kf.Salt, kf.Rounds)
+		}
+		if len(kf.PublicKeys) != 1 || kf.Keys != nil {
+			t.Errorf("Got %d public keys and private keys %v, want 1 and nil", len(kf.PublicKeys), kf.Keys)
+		}
+		if c, err := parseComment(pem.EncodeToMemory(blk)); err != nil || c != "" {
+			t.Errorf("parseComment: got %q, %v; want empty, no error", c, err)
+		}
+	})
+
+	t.Run("MultipleKeys", func(t *testing.T) {
+		kf, err := parseKeyFile(multi)
+		if err != nil {
+			t.Fatalf("parseKeyFile: unexpected error: %v", err)
+		}
+		var got []string
+		for _, key := range kf.Keys {
+			got = append(got, key.Type+" "+key.Comment)
+		}
+		if diff := cmp.Diff(got, []string{"ssh-ed25519 first", "ssh-ed25519 second"}); diff != "" {
+			t.Errorf("Keys (-got, +want):\n%s", diff)
+		}
+		if diff := cmp.Diff(kf.PublicKeys, pubs); diff != "" {
+			t.Errorf("Public keys (-got, +want):\n%s", diff)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		badPad := privateSection(1, 1, privs[:1], "x")
+		badPad[len(badPad)-1] = 0xff
+		rsaPub := keyBlob("ssh-rsa", []byte{1}, []byte{2})
+		tests := []struct {
+			name  string
+			input []byte
+			want  string
+		}{
+			{"Empty", nil, "not an OpenSSH key file"},
+			{"Magic", []byte("openssh-key-v2\x00"), "not an OpenSSH key file"},
+			{"Truncated", multi[:len(multi)-5], "private section"},
+			{"Trailing", append(bytes.Clone(multi), 0), "extra data"},
+			{"Checkint", keyFileBlob("none", "none", nil, pubs[:1],
+				privateSection(1, 2, privs[:1], "x")), "checkint mismatch"},
+			{"Padding", keyFileBlob("none", "none", nil, pubs[:1], badPad), "invalid padding"},
+			{"NoKeys", keyFileBlob("none", "none", nil, nil, privateSection(1, 1, nil)), "no keys"},
+			{"TooFewKeys", keyFileBlob("none", "none", nil, pubs,
+				privateSection(1, 1, privs[:1], "x")), "private key 2 type"},
+			{"TypeMismatch", keyFileBlob("none", "none", nil, [][]byte{rsaPub},
+				privateSection(1, 1, privs[:1], "x")), "does not match"},
+			{"Cipher", keyFileBlob("rot13", "bcrypt", nil, pubs[:1], make([]byte, 16)), "unsupported cipher"},
+			{"KDF", keyFileBlob("aes256-ctr", "scrypt", nil, pubs[:1], make([]byte, 16)), "unsupported KDF"},
+			{"NoKDF", keyFileBlob("aes256-ctr", "none", nil, pubs[:1], make([]byte, 16)), "requires a KDF"},
+			{"BlockSize", keyFileBlob("aes256-ctr", "bcrypt", bcryptOpts("salt", 16),
+				pubs[:1], make([]byte, 24)), "block size"},
+			{"KDFOptions", keyFileBlob("aes256-ctr", "bcrypt", []byte("junk"), pubs[:1], make([]byte, 16)), "bcrypt salt"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				kf, err := parseKeyFile(tc.input)
+				if err == nil {
+					t.Fatalf("parseKeyFile: got %+v, want error", kf)
+				} else if !strings.Contains(err.Error(), tc.want) {
+					t.Errorf("parseKeyFile: got error %q, want %q", err, tc.want)
+				}
+			})
+		}
+	})
+
+	t.Run("Comment", func(t *testing.T) {
+		for _, input := range [][]byte{mustGeneratePKCS1(t), testDSAKey} {
+			if c, err := parseComment(input); err != nil || c != "" {
+				t.Errorf("parseComment: got %q, %v; want empty, no error", c, err)
+			}
+		}
+		if _, err := parseComment([]byte("not a key")); err == nil {
+			t.Error("parseComment: got nil, want error")
+		}
+		bad := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: multi[:len(multi)-1]})
+		if c, err := parseComment(bad); err == nil {
+			t.Errorf("parseComment: got %q, want error", c)
+		}
+		good := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: multi})
+		if c, err := parseComment(good); err != nil || c != "first" {
+			t.Errorf("parseComment: got %q, %v; want first, no error", c, err)
+		}
+	})
+}
+
+func FuzzParseKeyFile(f *testing.F) {
+	key := ed25519.NewKeyFromSeed([]byte("00000000000000000000000000000001"))
+	if blk, err := ssh.MarshalPrivateKey(key, "fuzz"); err == nil {
+		f.Add(blk.Bytes)
+	}
+	if blk, err := ssh.MarshalPrivateKeyWithPassphrase(key, "fuzz", []byte("hunter2")); err == nil {
+		f.Add(blk.Bytes)
+	}
+	if data, err := os.ReadFile("testdata/test.key"); err == nil {
+		if blk, _ := pem.Decode(data); blk != nil {
+			f.Add(blk.Bytes)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		kf, err := parseKeyFile(data)
+		if err != nil {
+			return
+		}
+		if len(kf.PublicKeys) == 0 {
+			t.Error("Parsed key file has no public keys")
+		}
+		if kf.Cipher == "none" && len(kf.Keys) != len(kf.PublicKeys) {
+			t.Errorf("Got %d private keys, want %d", len(kf.Keys), len(kf.PublicKeys))
+		} else if kf.Cipher != "none" && kf.Keys != nil {
+			t.Errorf("Encrypted key file has %d private keys, want none", len(kf.Keys))
+		}
+	})
+}
+
+// appendString appends data to buf as an SSH length-prefixed string.
+func appendString(buf, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// keyBlob returns the wire encoding of a key of the given type with the given
+// fields, each encoded as a string.
+func keyBlob(keyType string, fields ...[]byte) []byte {
+	buf := appendString(nil, []byte(keyType))
+	for _, f := range fields {
+		buf = appendString(buf, f)
+	}
+	return buf
+}
+
+// bcryptOpts returns the encoded KDF options for the bcrypt KDF.
+func bcryptOpts(salt string, rounds uint32) []byte {
+	return binary.BigEndian.AppendUint32(appendString(nil, []byte(salt)), rounds)
+}
+
+// keyFileBlob returns the binary contents of a key file with the specified
+// contents. The private section is included as given.
+func keyFileBlob(cipher, kdf string, kdfOpts []byte, pubs [][]byte, priv []byte) []byte {
+	buf := []byte(keyFileMagic)
+	buf = appendString(buf, []byte(cipher))
+	buf = appendString(buf, []byte(kdf))
+	buf = appendString(buf, kdfOpts)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(pubs)))
+	for _, pub := range pubs {
+		buf = appendString(buf, pub)
+	}
+	return appendString(buf, priv)
+}
@@ -0,0 +1,263 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// keyFileMagic is the magic header of an OpenSSH private key file.
+const keyFileMagic = "openssh-key-v1\x00"
+
+// A keyFile is the parsed contents of an OpenSSH private key file, in the
+// format described by PROTOCOL.key in OpenSSH.
+//
+// See: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+type keyFile struct {
+	Cipher string // the cipher for the private section; "none" if unencrypted
+	KDF    string // the key derivation function; "none" if unencrypted
+	Salt   []byte // the KDF salt, for the "bcrypt" KDF
+	Rounds uint32 // the number of KDF rounds, for the "bcrypt" KDF
+
+	PublicKeys [][]byte       // the public keys, in wire format
+	Keys       []keyFileEntry // the private keys; nil if encrypted
+}
+
+// A keyFileEntry is a private key from the private section of a key file.
+type keyFileEntry struct {
+	Type    string // the key type, for example "ssh-ed25519"
+	Data    []byte // the encoded key fields following the type
+	Comment string // the key comment
+}
+
+// keyCipher describes a cipher used to encrypt the private section of a key
+// file.
+type keyCipher struct {
+	blockSize int // the cipher block size in bytes
+	authLen   int // the length of the authentication tag, for AEAD ciphers
+}
+
+// keyCiphers are the ciphers supported by OpenSSH for key files.
+var keyCiphers = map[string]keyCipher{
+	"none":                          {8, 0},
+	"3des-cbc":                      {8, 0},
+	"aes128-cbc":                    {16, 0},
+	"aes192-cbc":                    {16, 0},
+	"aes256-cbc":                    {16, 0},
+	"aes128-ctr":                    {16, 0},
+	"aes192-ctr":                    {16, 0},
+	"aes256-ctr":                    {16, 0},
+	"aes128-gcm@openssh.com":        {16, 16},
+	"aes256-gcm@openssh.com":        {16, 16},
+	"chacha20-poly1305@openssh.com": {8, 16},
+}
+
+// privateKeyFields gives the layout of the fields of each supported type of
+// private key, following the key type in the private section of a key file:
+// Each "s" is a string (or an mpint), and each "b" is a single byte.
+var privateKeyFields = map[string]string{
+	"ssh-ed25519":         "ss",     // public key, private key
+	"ssh-rsa":             "ssssss", // n, e, d, iqmp, p, q
+	"ssh-dss":             "sssss",  // p, q, g, y, x
+	"ecdsa-sha2-nistp256": "sss",    // curve, public point, private scalar
+	"ecdsa-sha2-nistp384": "sss",
+	"ecdsa-sha2-nistp521": "sss",
+
+	// Security keys: The public key, followed by the application, flags,
+	// key handle, and reserved field.
+	"sk-ssh-ed25519@openssh.com":         "ssbss",
+	"sk-ecdsa-sha2-nistp256@openssh.com": "sssbss",
+
+	// Certified keys: The certificate, followed by the private fields that
+	// are not part of the certificate.
+	"ssh-ed25519-cert-v01@openssh.com":            "sss",
+	"ssh-rsa-cert-v01@openssh.com":                "sssss",
+	"ssh-dss-cert-v01@openssh.com":                "ss",
+	"ecdsa-sha2-nistp256-cert-v01@openssh.com":    "ss",
+	"ecdsa-sha2-nistp384-cert-v01@openssh.com":    "ss",
+	"ecdsa-sha2-nistp521-cert-v01@openssh.com":    "ss",
+	"sk-ssh-ed25519-cert-v01@openssh.com":         "ssbss",
+	"sk-ecdsa-sha2-nistp256-cert-v01@openssh.com": "ssbss",
+}
+
+// parseKeyFile parses the binary contents of an OpenSSH private key file. If
+// the private section is encrypted, its contents are not parsed, and the Keys
+// field of the result is nil.
+func parseKeyFile(data []byte) (*keyFile, error) {
+	s := newScanner(data)
+	if err := s.scanLiteral(keyFileMagic); err != nil {
+		return nil, errors.New("not an OpenSSH key file")
+	}
+	cipher, err := s.scanString()
+	if err != nil {
+		return nil, fmt.Errorf("cipher name: %w", err)
+	}
+	kdf, err := s.scanString()
+	if err != nil {
+		return nil, fmt.Errorf("KDF name: %w", err)
+	}
+	kdfOpts, err := s.scanString()
+	if err != nil {
+		return nil, fmt.Errorf("KDF options: %w", err)
+	}
+	kf := &keyFile{Cipher: string(cipher), KDF: string(kdf)}
+	kc, ok := keyCiphers[kf.Cipher]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher %q", kf.Cipher)
+	}
+	if err := kf.parseKDF(kdfOpts); err != nil {
+		return nil, err
+	}
+
+	n, err := s.scanUint32()
+	if err != nil {
+		return nil, fmt.Errorf("key count: %w", err)
+	} else if n == 0 {
+		return nil, errors.New("no keys in key file")
+	} else if uint64(n)*4 > uint64(len(s.buf)) {
+		return nil, fmt.Errorf("key count %d exceeds the file size", n)
+	}
+	types := make([]string, n)
+	for i := range types {
+		pub, err := s.scanString()
+		if err != nil {
+			return nil, fmt.Errorf("public key %d: %w", i+1, err)
+		}
+		typ, err := newScanner(pub).scanString()
+		if err != nil {
+			return nil, fmt.Errorf("public key %d type: %w", i+1, err)
+		}
+		kf.PublicKeys = append(kf.PublicKeys, pub)
+		types[i] = string(typ)
+	}
+
+	priv, err := s.scanString()
+	if err != nil {
+		return nil, fmt.Errorf("private section: %w", err)
+	} else if len(priv) < kc.blockSize || len(priv)%kc.blockSize != 0 {
+		return nil, fmt.Errorf("private section length %d is not a multiple of the block size %d", len(priv), kc.blockSize)
+	}
+	if err := s.skipBytes(kc.authLen); err != nil {
+		return nil, fmt.Errorf("authentication tag: %w", err)
+	} else if !s.atEOF() {
+		return nil, errors.New("extra data after private section")
+	}
+	if kf.Cipher != "none" {
+		return kf, nil // encrypted; we cannot read the private section
+	}
+	if err := kf.parsePrivate(priv, types, kc.blockSize); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+// parseKDF parses the KDF options for the KDF of kf, and checks that the
+// KDF is consistent with the cipher.
+func (kf *keyFile) parseKDF(opts []byte) error {
+	switch kf.KDF {
+	case "none":
+		if kf.Cipher != "none" {
+			return fmt.Errorf("cipher %q requires a KDF", kf.Cipher)
+		} else if len(opts) != 0 {
+			return errors.New("unexpected options for KDF none")
+		}
+	case "bcrypt":
+		if kf.Cipher == "none" {
+			return errors.New("KDF bcrypt requires a cipher")
+		}
+		s := newScanner(opts)
+		salt, err := s.scanString()
+		if err != nil {
+			return fmt.Errorf("bcrypt salt: %w", err)
+		}
+		rounds, err := s.scanUint32()
+		if err != nil {
+			return fmt.Errorf("bcrypt rounds: %w", err)
+		} else if !s.atEOF() {
+			return errors.New("extra data after bcrypt options")
+		}
+		kf.Salt, kf.Rounds = salt, rounds
+	default:
+		return fmt.Errorf("unsupported KDF %q", kf.KDF)
+	}
+	return nil
+}
+
+// parsePrivate parses the unencrypted private section of a key file, which
+// must hold private keys of the specified types, followed by padding to a
+// multiple of blockSize.
+func (kf *keyFile) parsePrivate(priv []byte, types []string, blockSize int) error {
+	s := newScanner(priv)
+	check1, err := s.scanUint32()
+	if err != nil {
+		return fmt.Errorf("checkint: %w", err)
+	}
+	check2, err := s.scanUint32()
+	if err != nil {
+		return fmt.Errorf("checkint: %w", err)
+	} else if check1 != check2 {
+		return fmt.Errorf("checkint mismatch (%08x != %08x)", check1, check2)
+	}
+	for i, want := range types {
+		typ, err := s.scanString()
+		if err != nil {
+			return fmt.Errorf("private key %d type: %w", i+1, err)
+		} else if string(typ) != want {
+			return fmt.Errorf("private key %d type %q does not match public key type %q", i+1, typ, want)
+		}
+		layout, ok := privateKeyFields[want]
+		if !ok {
+			return fmt.Errorf("private key %d has unsupported type %q", i+1, want)
+		}
+		start := s.buf
+		for _, f := range layout {
+			if f == 'b' {
+				_, err = s.scanByte()
+			} else {
+				_, err = s.scanString()
+			}
+			if err != nil {
+				return fmt.Errorf("private key %d: %w", i+1, err)
+			}
+		}
+		data := start[:len(start)-len(s.buf)]
+		comment, err := s.scanString()
+		if err != nil {
+			return fmt.Errorf("private key %d comment: %w", i+1, err)
+		}
+		kf.Keys = append(kf.Keys, keyFileEntry{Type: want, Data: data, Comment: string(comment)})
+	}
+
+	// The remainder is padding 1, 2, 3, ... up to a multiple of the block size.
+	if len(s.buf) >= blockSize {
+		return fmt.Errorf("got %d bytes of padding, want at most %d", len(s.buf), blockSize-1)
+	}
+	for i, b := range s.buf {
+		if int(b) != i+1 {
+			return fmt.Errorf("invalid padding byte %d at offset %d", b, i)
+		}
+	}
+	return nil
+}
+
+// parseComment extracts the comment of the first key from the PEM-encoded key
+// file. For key formats other than the OpenSSH format, which do not have a
+// comment, and for encrypted OpenSSH keys, it returns "" without error.
+func parseComment(key []byte) (string, error) {
+	blk, _ := pem.Decode(key)
+	if blk == nil {
+		return "", errors.New("no PEM data found")
+	} else if blk.Type != "OPENSSH PRIVATE KEY" {
+		return "", nil
+	}
+	kf, err := parseKeyFile(blk.Bytes)
+	if err != nil {
+		return "", err
+	} else if len(kf.Keys) == 0 {
+		return "", nil // encrypted
+	}
+	return kf.Keys[0].Comment, nil
+}
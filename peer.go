@@ -0,0 +1,147 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"slices"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// A Peer identifies the process on the other end of an agent connection.
+type Peer struct {
+	UID int // the user ID of the peer process
+	GID int // the group ID of the peer process
+	PID int // the process ID of the peer; 0 if unknown
+
+	// Exe is the absolute path of the executable run by the peer process,
+	// or "" if unknown. Parents are the executables of its ancestors, nearest
+	// first, as far as needed by the policy (see KeyPolicy.ParentDepth).
+	Exe     string
+	Parents []string
+}
+
+// String returns a human-readable description of p.
+func (p Peer) String() string {
+	if p.Exe != "" {
+		return fmt.Sprintf("pid %d %s (uid %d, gid %d)", p.PID, p.Exe, p.UID, p.GID)
+	}
+	return fmt.Sprintf("pid %d (uid %d, gid %d)", p.PID, p.UID, p.GID)
+}
+
+// ServePeer serves the agent to the specified connection, on behalf of the
+// specified peer. A nil peer means the identity of the peer is unknown.
+// ServePeer is for connections that are not Unix sockets, or whose peer is
+// known to the caller by other means; see also [Server.ServeOne].
+//
+// If the server has an allow-list of peers (see Config.AllowUIDs and
+// Config.AllowGIDs), ServePeer reports an error without serving the
+// connection if peer is not permitted by it.
+func (s *Server) ServePeer(rw io.ReadWriter, peer *Peer) error {
+	if err := s.checkPeer(peer); err != nil {
+		if peer != nil {
+			s.logPrintf("Rejected connection from %s: %v", peer, err)
+		} else {
+			s.logPrintf("Rejected connection: %v", err)
+		}
+		return err
+	}
+	return agent.ServeAgent(&conn{s: s, peer: peer}, rw)
+}
+
+// checkPeer reports an error if peer is not permitted to connect to s.
+func (s *Server) checkPeer(peer *Peer) error {
+	if len(s.allowUIDs) == 0 && len(s.allowGIDs) == 0 {
+		return nil // no restrictions
+	} else if peer == nil {
+		return errors.New("agent: peer identity is unknown")
+	} else if slices.Contains(s.allowUIDs, peer.UID) || slices.Contains(s.allowGIDs, peer.GID) {
+		return nil
+	}
+	return errors.New("agent: peer is not permitted")
+}
+
+// connPeer returns the identity of the peer of rw, if it is a Unix socket
+// whose peer credentials are available. Otherwise it returns nil.
+func (s *Server) connPeer(rw io.ReadWriter) *Peer {
+	uc, ok := rw.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	peer, err := peerCredentials(uc)
+	if err != nil {
+		s.logPrintf("WARNING: reading peer credentials: %v", err)
+		return nil
+	}
+	if peer.PID != 0 && (s.askpass != "" || s.needPrograms()) {
+		s.resolvePrograms(peer) // for program policies and confirmation prompts
+	}
+	return peer
+}
+
+// needPrograms reports whether any policy of s restricts keys by program.
+func (s *Server) needPrograms() bool {
+	return slices.ContainsFunc(s.policies, func(p KeyPolicy) bool { return len(p.Programs) != 0 })
+}
+
+// resolvePrograms populates the Exe and Parents fields of peer from its
+// process ID. Parents are resolved only as far as the deepest ParentDepth of
+// the policies of s. Errors are logged, and leave the affected fields unset.
+//
+// The process ID of a peer is captured when it connects, so by the time we
+// inspect it, the process may have exited, and its ID may have been reused.
+// This is a limitation shared with other agents that check the peer process.
+func (s *Server) resolvePrograms(peer *Peer) {
+	exe, err := processExe(peer.PID)
+	if err != nil {
+		s.logPrintf("WARNING: resolving executable of pid %d: %v", peer.PID, err)
+		return
+	}
+	peer.Exe = exe
+
+	var depth int
+	for _, p := range s.policies {
+		depth = max(depth, p.ParentDepth)
+	}
+	for pid := peer.PID; len(peer.Parents) < depth; {
+		ppid, err := parentPID(pid)
+		if err != nil {
+			s.logPrintf("WARNING: resolving parent of pid %d: %v", pid, err)
+			return
+		} else if ppid <= 1 {
+			return // no more ancestors we care about
+		}
+		exe, err := processExe(ppid)
+		if err != nil {
+			s.logPrintf("WARNING: resolving executable of pid %d: %v", ppid, err)
+			return
+		}
+		peer.Parents = append(peer.Parents, exe)
+		pid = ppid
+	}
+}
+
+// checkProgram reports an error if p restricts keys to programs that do not
+// include the program run by peer, or its permitted ancestors.
+func checkProgram(p *KeyPolicy, peer *Peer) error {
+	if p == nil || len(p.Programs) == 0 {
+		return nil // no restrictions
+	} else if peer == nil || peer.Exe == "" {
+		return errors.New("agent: key is restricted to programs, but the peer program is unknown")
+	}
+	exes := append([]string{peer.Exe}, peer.Parents[:min(len(peer.Parents), max(p.ParentDepth, 0))]...)
+	for _, exe := range exes {
+		for _, prog := range p.Programs {
+			if ok, _ := path.Match(prog, exe); ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("agent: key may not be used by program %q", peer.Exe)
+}
@@ -0,0 +1,30 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package tskagent
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+// peerCredentials reports an error, since reading peer credentials is not
+// supported on this platform.
+func peerCredentials(uc *net.UnixConn) (*Peer, error) {
+	return nil, errors.New("peer credentials are not supported on " + runtime.GOOS)
+}
+
+// processExe reports an error, since inspecting processes is not supported on
+// this platform.
+func processExe(pid int) (string, error) {
+	return "", errors.New("process inspection is not supported on " + runtime.GOOS)
+}
+
+// parentPID reports an error, since inspecting processes is not supported on
+// this platform.
+func parentPID(pid int) (int, error) {
+	return 0, errors.New("process inspection is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,379 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/setec/types/api"
+)
+
+// A secretSet describes the secrets the agent should serve, as reported by
+// the secrets service at the start of an update.
+type secretSet struct {
+	keys        map[string]api.SecretVersion // key secrets and their active versions
+	certs       map[string]api.SecretVersion // certificate secrets and their active versions
+	passphrases map[string]api.SecretVersion // passphrase secrets and their active versions
+	values      map[string]*api.SecretValue  // values fetched while checking versions
+	failed      map[string]error             // secrets whose versions are unknown
+}
+
+func newSecretSet() *secretSet {
+	return &secretSet{
+		keys:        make(map[string]api.SecretVersion),
+		certs:       make(map[string]api.SecretVersion),
+		passphrases: make(map[string]api.SecretVersion),
+		values:      make(map[string]*api.SecretValue),
+		failed:      make(map[string]error),
+	}
+}
+
+// merge adds the contents of other to set.
+func (set *secretSet) merge(other *secretSet) {
+	maps.Copy(set.keys, other.keys)
+	maps.Copy(set.certs, other.certs)
+	maps.Copy(set.passphrases, other.passphrases)
+	maps.Copy(set.values, other.values)
+	maps.Copy(set.failed, other.failed)
+}
+
+// add records that the named secret has the specified active version.
+func (set *secretSet) add(name string, v api.SecretVersion) {
+	switch {
+	case strings.HasSuffix(name, certSuffix):
+		set.certs[name] = v
+	case strings.HasSuffix(name, passphraseSuffix):
+		set.passphrases[name] = v
+	default:
+		set.keys[name] = v
+	}
+}
+
+// keySecret returns the name of the key secret to which the named secret
+// belongs, and reports whether the named secret is an auxiliary secret (a
+// certificate or passphrase) rather than the key itself.
+func keySecret(name string) (string, bool) {
+	if base, ok := strings.CutSuffix(name, certSuffix); ok {
+		return base, true
+	} else if base, ok := strings.CutSuffix(name, passphraseSuffix); ok {
+		return base, true
+	}
+	return name, false
+}
+
+// A namePattern selects secret names, as described for Config.Include.
+type namePattern struct {
+	glob string // a pattern in the syntax of path.Match
+	dir  bool   // whether glob matches a directory containing the secret
+	n    int    // the number of path components in glob, if dir is true
+}
+
+// parsePatterns parses and validates the specified secret name patterns.
+func parsePatterns(pats []string) ([]namePattern, error) {
+	var out []namePattern
+	for _, pat := range pats {
+		glob, dir := strings.CutSuffix(pat, "/")
+		if _, err := path.Match(glob, ""); err != nil || glob == "" {
+			return nil, fmt.Errorf("invalid secret name pattern %q", pat)
+		}
+		out = append(out, namePattern{glob: glob, dir: dir, n: strings.Count(glob, "/") + 1})
+	}
+	return out, nil
+}
+
+// prefixPattern returns a pattern matching secrets beneath the specified
+// prefix, treating the prefix literally.
+func prefixPattern(prefix string) namePattern {
+	var buf strings.Builder
+	for _, r := range strings.TrimSuffix(prefix, "/") {
+		if strings.ContainsRune(`*?[\`, r) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	glob := buf.String()
+	return namePattern{glob: glob, dir: true, n: strings.Count(glob, "/") + 1}
+}
+
+// match reports whether p matches the specified secret name. If maxDepth is
+// positive, a directory pattern matches only secrets at most maxDepth levels
+// below the directory.
+func (p namePattern) match(name string, maxDepth int) bool {
+	if !p.dir {
+		ok, _ := path.Match(p.glob, name)
+		return ok
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) <= p.n || (maxDepth > 0 && len(parts)-p.n > maxDepth) {
+		return false
+	}
+	ok, _ := path.Match(p.glob, strings.Join(parts[:p.n], "/"))
+	return ok
+}
+
+// selected reports whether the specified secret is selected by the include
+// and exclude patterns of s. A certificate or passphrase is selected if its
+// key is.
+func (s *Server) selected(name string) bool {
+	name, _ = keySecret(name)
+	return slices.ContainsFunc(s.include, func(p namePattern) bool { return p.match(name, s.maxDepth) }) &&
+		!slices.ContainsFunc(s.exclude, func(p namePattern) bool { return p.match(name, 0) })
+}
+
+// selectSecrets reports the secrets the agent should serve: Those selected by
+// the include patterns, if there are any, and those named explicitly or by
+// the manifest.
+func (s *Server) selectSecrets(ctx context.Context) (*secretSet, error) {
+	set := newSecretSet()
+	if len(s.include) != 0 {
+		var err error
+		set, err = s.listSecrets(ctx)
+		if errors.Is(err, api.ErrAccessDenied) {
+			set, err = s.probeKnown(ctx, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	names, err := s.explicitNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the explicitly named secrets we have not already seen.
+	known := s.knownVersions()
+	check := make(map[string]api.SecretVersion)
+	for _, name := range names {
+		if _, ok := set.keys[name]; ok {
+			continue
+		} else if _, ok := set.failed[name]; ok {
+			continue
+		}
+		check[name] = known[name]
+		check[name+certSuffix] = known[name+certSuffix]
+		check[name+passphraseSuffix] = known[name+passphraseSuffix]
+	}
+	set.merge(s.probeSecrets(ctx, check))
+	return set, nil
+}
+
+// listSecrets lists the secrets selected by the patterns of s.
+func (s *Server) listSecrets(ctx context.Context) (*secretSet, error) {
+	ss, err := s.setecClient.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	set := newSecretSet()
+	for _, sec := range ss {
+		if !s.selected(sec.Name) {
+			continue // not selected, skip this one
+		}
+		set.add(sec.Name, sec.ActiveVersion)
+	}
+	return set, nil
+}
+
+// probeKnown checks the secrets whose keys s already has, for use when the
+// agent is not permitted to list secrets. It uses conditional fetches, so
+// that the secrets service only sends the values of secrets that changed.
+// Since it cannot list secrets, probeKnown does not find new ones. If there
+// are no known or explicitly named secrets, so that there is nothing to serve,
+// it reports listErr, the error from listing.
+func (s *Server) probeKnown(ctx context.Context, listErr error) (*secretSet, error) {
+	known := s.knownVersions()
+	if len(known) == 0 && len(s.names) == 0 && s.manifest == "" {
+		return nil, fmt.Errorf("list secrets: %w (and no secrets are known)", listErr)
+	}
+	s.logPrintf("[update] not permitted to list secrets; checking %d known secrets", len(known))
+	return s.probeSecrets(ctx, known), nil
+}
+
+// knownVersions returns the versions of the key, certificate, and passphrase
+// secrets whose keys s has, including those removed by clients. Passphrase
+// secrets named by envelopes are not included.
+func (s *Server) knownVersions() map[string]api.SecretVersion {
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	known := make(map[string]api.SecretVersion)
+	for _, key := range s.keys {
+		known[key.Name] = key.Version
+		known[key.Name+certSuffix] = key.CertVersion
+		if key.PassName == "" {
+			known[key.Name+passphraseSuffix] = key.PassVersion
+		}
+	}
+	for name, v := range s.removed {
+		known[name] = v
+	}
+	return known
+}
+
+// explicitNames returns the names of secrets listed in the config and the
+// manifest, if there is one. The manifest is fetched only if it has changed.
+// A manifest that does not exist lists no secrets, so deleting the manifest
+// withdraws the secrets it listed.
+func (s *Server) explicitNames(ctx context.Context) ([]string, error) {
+	names := slices.Clone(s.names)
+	if s.manifest == "" {
+		return names, nil
+	}
+	s.manifestμ.Lock()
+	defer s.manifestμ.Unlock()
+
+	var sv *api.SecretValue
+	var err error
+	if s.manifestVersion == 0 {
+		sv, err = s.setecClient.Get(ctx, s.manifest)
+	} else {
+		sv, err = s.setecClient.GetIfChanged(ctx, s.manifest, s.manifestVersion)
+	}
+	if errors.Is(err, api.ErrValueNotChanged) {
+		return append(names, s.manifestNames...), nil
+	} else if errors.Is(err, api.ErrNotFound) {
+		if s.manifestVersion != 0 || s.manifestNames == nil { // log once per deletion
+			s.logPrintf("[update] WARNING: manifest %q not found; serving no secrets from it", s.manifest)
+		}
+		s.manifestVersion, s.manifestNames = 0, []string{}
+		return names, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("get manifest %q: %w", s.manifest, err)
+	}
+	s.manifestVersion, s.manifestNames = sv.Version, parseManifest(sv.Value)
+	s.logPrintf("[update] manifest %q version %d lists %d secrets", s.manifest, sv.Version, len(s.manifestNames))
+	return append(names, s.manifestNames...), nil
+}
+
+// parseManifest parses the secret names listed in a manifest.
+func parseManifest(data []byte) []string {
+	var names []string
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names
+}
+
+// probeSecrets checks the current versions of the specified secrets, given
+// the versions we have (0 if none). The values of secrets that changed are
+// recorded in the result, so they need not be fetched again. Secrets that do
+// not exist are omitted from the result.
+//
+// A certificate or passphrase secret that we do not have is probed only if its
+// key is new or has changed, or if it has not been found missing within the
+// last auxProbeInterval, so that keys without them do not cost extra requests
+// on every update.
+func (s *Server) probeSecrets(ctx context.Context, have map[string]api.SecretVersion) *secretSet {
+	set := newSecretSet()
+	keys, aux := make(map[string]api.SecretVersion), make(map[string]api.SecretVersion)
+	for name, v := range have {
+		if _, ok := keySecret(name); ok {
+			aux[name] = v
+		} else {
+			keys[name] = v
+		}
+	}
+	s.probeEach(ctx, set, keys)
+
+	now := time.Now()
+	s.probeμ.Lock()
+	for name, v := range aux {
+		base, _ := keySecret(name)
+		if v != 0 || set.values[base] != nil {
+			continue // previously seen, or the key is new or changed
+		} else if t, ok := s.auxMissed[name]; ok && now.Sub(t) < auxProbeInterval {
+			delete(aux, name)
+		}
+	}
+	s.probeμ.Unlock()
+	s.probeEach(ctx, set, aux)
+	return set
+}
+
+// auxProbeInterval is the minimum interval between probes for a certificate
+// or passphrase secret that was not found, unless its key changes.
+const auxProbeInterval = time.Hour
+
+// probeEach probes the specified secrets for probeSecrets, recording the
+// results in set.
+func (s *Server) probeEach(ctx context.Context, set *secretSet, have map[string]api.SecretVersion) {
+	var setμ sync.Mutex
+	g, start := taskgroup.New(nil).Limit(s.updateConcurrency)
+	for name, v := range have {
+		start(func() error {
+			var sv *api.SecretValue
+			var err error
+			if v == 0 {
+				sv, err = s.setecClient.Get(ctx, name)
+			} else {
+				sv, err = s.setecClient.GetIfChanged(ctx, name, v)
+			}
+			base, aux := keySecret(name)
+			missing := errors.Is(err, api.ErrNotFound) ||
+				// We may not be permitted to see a certificate or passphrase
+				// that does not exist; treat that the same as not found.
+				(errors.Is(err, api.ErrAccessDenied) && v == 0 && aux)
+			if aux {
+				s.noteAux(name, missing)
+			}
+			setμ.Lock()
+			defer setμ.Unlock()
+			switch {
+			case errors.Is(err, api.ErrValueNotChanged):
+				set.add(name, v)
+			case missing:
+				// The secret does not exist (any longer).
+				if !aux {
+					s.logPrintf("[update] secret %q not found", name)
+				}
+			case err != nil:
+				set.failed[base] = fmt.Errorf("get %q: %w", name, err)
+			default:
+				set.add(name, sv.Version)
+				set.values[name] = sv
+			}
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+// noteAux records whether the named certificate or passphrase secret was
+// found missing by a probe.
+func (s *Server) noteAux(name string, missing bool) {
+	s.probeμ.Lock()
+	defer s.probeμ.Unlock()
+	if !missing {
+		delete(s.auxMissed, name)
+		return
+	}
+	if s.auxMissed == nil {
+		s.auxMissed = make(map[string]time.Time)
+	}
+	s.auxMissed[name] = time.Now()
+}
+
+// getVersion returns the specified version of the named secret, using the
+// value recorded in set if there is one.
+func (s *Server) getVersion(ctx context.Context, set *secretSet, name string, v api.SecretVersion) (*api.SecretValue, error) {
+	if sv, ok := set.values[name]; ok && sv.Version == v {
+		return sv, nil
+	}
+	sv, err := s.setecClient.GetVersion(ctx, name, v)
+	if err != nil {
+		return nil, fmt.Errorf("get %q version %d: %w", name, v, err)
+	}
+	return sv, nil
+}
@@ -3,32 +3,56 @@
 
 // Package tskagent implements an SSH key agent backed by the [setec] service.
 //
-// A [Server] implements an [agent.Agent] that serves SSH keys stored in the
-// specified setec server. Each secret whose name matches a designated prefix
-// and contains an SSH private key in OpenSSH PEM format is offered by the
-// agent to callers on the local system.
+// A [Server] implements an [agent.ExtendedAgent] that serves SSH keys stored
+// in the specified setec server. Each secret whose name is selected by the
+// configuration and contains an SSH private key in OpenSSH PEM format is
+// offered by the agent to callers on the local system.
+//
+// If there is also a secret with the same name plus the suffix "-cert.pub"
+// containing an OpenSSH certificate for the key, in authorized_keys format, the
+// agent offers the certificate alongside the key.
+//
+// A secret may also bundle several keys, as concatenated PEM blocks or as a
+// JSON array of envelopes (see [Envelope]). The keys in a bundle share the
+// version of the secret, and are updated together.
+//
+// A key may be encrypted with a passphrase, if there is also a secret with the
+// same name plus the suffix ".passphrase" containing the passphrase, or a
+// secret named by the Passphrase field of its envelope. A single trailing
+// newline in the passphrase secret is ignored. The comment of an encrypted key
+// is lost when it is decrypted; see Config.CommentTemplate.
 //
 // [setec]: https://github.com/tailscale/setec
 package tskagent
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/binary"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"maps"
 	"net"
-	"strings"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/creachadair/taskgroup"
 	"github.com/tailscale/setec/client/setec"
 	"github.com/tailscale/setec/types/api"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -38,43 +62,374 @@ type Config struct {
 	// Client is the client for the secrets service. It must be set.
 	Client setec.Client
 
-	// Prefix is the secret name prefix to be served.  It must be non-empty.
+	// Prefix, if set, is a secret name prefix to be served. It is equivalent
+	// to an Include pattern for the prefix, matched literally. At least one
+	// of Prefix, Include, Names, and Manifest must be set.
 	Prefix string
 
+	// Include, if set, are patterns selecting the secrets to be served. A
+	// pattern is in the syntax of [path.Match], and matches secret names in
+	// full. A pattern ending in "/" instead matches every secret beneath a
+	// directory matching the rest of the pattern. For example, the pattern
+	// "prod/*/ssh-keys/" matches "prod/web/ssh-keys/deploy" and also
+	// "prod/web/ssh-keys/ci/deploy", but "prod/*/ssh-keys/*" matches only
+	// the former.
+	//
+	// A certificate secret is selected if the secret for its key is.
+	Include []string
+
+	// Exclude, if set, are patterns in the same syntax as Include. Secrets
+	// selected by Prefix or Include that match any Exclude pattern are not
+	// served. Exclude does not apply to Names and Manifest.
+	Exclude []string
+
+	// MaxDepth, if positive, limits the secrets selected by Prefix and by
+	// Include patterns ending in "/" to those at most MaxDepth levels below
+	// the matching directory. For example, with MaxDepth 1 only secrets
+	// directly in the directory are selected.
+	MaxDepth int
+
+	// Names, if set, are the names of secrets to be served, in addition to
+	// those selected by Prefix and Include. Explicitly named secrets are
+	// fetched individually, so the agent does not need permission to list
+	// secrets.
+	Names []string
+
+	// Manifest, if set, is the name of a secret listing the names of other
+	// secrets to be served, in addition to those selected above.
+	// The manifest has one secret name per line; blank lines and lines
+	// beginning with "#" are ignored. If the manifest does not exist, it is
+	// treated as empty, so deleting it withdraws the secrets it listed.
+	Manifest string
+
 	// Logf, if set, is used to write logs. If nil, logs are discarded.
 	Logf func(string, ...any)
+
+	// AllowAdd, if true, allows clients to add keys to the agent.  Added keys
+	// are held only in memory, and are never written to the secrets service.
+	// If false, attempts to add keys report an error.
+	AllowAdd bool
+
+	// Policies, if set, are usage policies for the keys served by the agent.
+	// The first policy whose pattern matches the name of a secret applies to
+	// the keys stored in that secret, except that Confirm applies if it is set
+	// in any matching policy.
+	Policies []KeyPolicy
+
+	// Askpass, if set, is the path of a program to run to confirm each use of
+	// a key that requires confirmation, in the style of SSH_ASKPASS.
+	//
+	// The program is run with a prompt describing the request as its only
+	// argument, and with SSH_ASKPASS_PROMPT=confirm in its environment. The
+	// environment also includes TSKAGENT_SECRET_NAME, TSKAGENT_KEY_COMMENT,
+	// and TSKAGENT_KEY_FINGERPRINT describing the key, and, if the requesting
+	// process is known, TSKAGENT_PEER_PID, TSKAGENT_PEER_UID, and
+	// TSKAGENT_PEER_EXE describing it. The key is used only if the program
+	// exits with status 0.
+	//
+	// If Askpass is empty, keys that require confirmation cannot be used.
+	Askpass string
+
+	// Audit, if set, is called with a record of each signature made by the
+	// agent. If nil, the records are written to Logf.
+	Audit func(SignRecord)
+
+	// StrictSign, if true, makes the agent refuse to sign data that is not an
+	// SSH userauth request or an SSHSIG message.
+	StrictSign bool
+
+	// KnownHosts, if set, are the paths of known_hosts files used to check
+	// the hostnames listed in the Hosts field of a KeyPolicy.
+	KnownHosts []string
+
+	// StrictUpdate, if true, makes Update all-or-nothing: If any secret cannot
+	// be fetched, Update keeps the existing keys. By default, Update applies
+	// the secrets it could fetch, and keeps the previous keys for the rest.
+	StrictUpdate bool
+
+	// UpdateConcurrency is the maximum number of secrets that Update fetches
+	// concurrently. If zero, a default is used. If negative, there is no limit.
+	UpdateConcurrency int
+
+	// MaxStale, if positive, is the longest time the agent serves a key after
+	// it was last confirmed current by a successful update. If updates fail
+	// for longer than this, for example because the secrets service is
+	// unreachable, the key is withheld (fail closed) until an update succeeds.
+	// By default, keys are served until they are updated or removed.
+	// See also KeyPolicy.MaxStale.
+	MaxStale time.Duration
+
+	// Cache, if non-nil, is where the agent stores a copy of the keys it
+	// fetches, encrypted with CacheKey, after each update that succeeds, in
+	// whole or in part (see UpdateResult.Missing). If the secrets service is
+	// unreachable when the agent starts, the caller can use
+	// [Server.LoadCache] to load the keys from the cache instead.
+	Cache Cache
+
+	// CacheKey is the key used to encrypt the cache, of length CacheKeyLen.
+	// It is required if Cache is set.
+	CacheKey []byte
+
+	// CacheMaxAge, if positive, is the maximum age of a cache that
+	// LoadCache will accept. By default, any age is accepted.
+	CacheMaxAge time.Duration
+
+	// RotationGrace, if positive, is how long the agent continues to serve the
+	// key from the previously active version of a secret after Update finds
+	// that a new version was activated. This gives hosts time to accept the
+	// new key before the old one is withdrawn. The previous key is listed
+	// after the current keys, and its comment is marked as superseded.
+	RotationGrace time.Duration
+
+	// CommentTemplate, if set, is a template for the comments of keys from
+	// secrets that have no comment of their own, such as PKCS#1 and PKCS#8
+	// keys, and OpenSSH keys generated without a comment. In the template,
+	// {name} is replaced by the secret name, {basename} by the last element
+	// of the name, {version} by the secret version, {fingerprint} by the
+	// SHA256 fingerprint of the key, and {comment} by the comment of the key.
+	// If the template refers to {comment}, it applies to all keys from
+	// secrets, not only those without a comment. There is no way to write a
+	// literal "{" in the template. The template is applied when keys are
+	// fetched from setec and when they are loaded from the cache, so the
+	// key values stored in setec are unaffected. See also [Server.Keys].
+	CommentTemplate string
+
+	// MissUpdateInterval, if positive, enables on-demand updates: When a
+	// client asks the agent to sign with a key it does not have, the agent
+	// runs Update and tries again, in case the key was recently added to the
+	// secrets service. To limit the load on the secrets service, on-demand
+	// updates are run at most once per MissUpdateInterval, and concurrent
+	// misses share a single update.
+	MissUpdateInterval time.Duration
+
+	// MissUpdateOnList, if true, also runs an on-demand update when List would
+	// report no keys. It has no effect unless MissUpdateInterval is positive.
+	MissUpdateOnList bool
+
+	// AllowUIDs and AllowGIDs, if either is non-empty, restrict which peers
+	// may connect to the agent. A peer is permitted if its user ID is listed
+	// in AllowUIDs, or its group ID is listed in AllowGIDs. Connections whose
+	// peer identity is unknown are rejected.
+	AllowUIDs []int
+	AllowGIDs []int
+}
+
+// A KeyPolicy specifies restrictions on the use of keys stored in secrets
+// whose names match a pattern.
+type KeyPolicy struct {
+	// Match is a pattern in the syntax of [path.Match] selecting the secret
+	// names to which the policy applies. It must be non-empty.
+	Match string
+
+	// Confirm, if true, requires each use of a matching key for signing to be
+	// confirmed by the user (see Config.Askpass). Unlike the other fields, it
+	// applies even if an earlier policy also matches the key.
+	Confirm bool
+
+	// HostKeys, if non-empty, restricts matching keys to authenticating to
+	// servers with these host keys, given as SHA256 fingerprints in the format
+	// printed by "ssh-keygen -l" (for example, "SHA256:...").
+	HostKeys []string
+
+	// Hosts, if non-empty, restricts matching keys to authenticating to these
+	// hosts. A host is permitted if the host key of the server is listed for
+	// that hostname in one of the files named by Config.KnownHosts.
+	Hosts []string
+
+	// NoForwarding, if true, prevents matching keys from being used over a
+	// forwarded agent connection.
+	NoForwarding bool
+
+	// Programs, if non-empty, restricts matching keys to peers running one of
+	// these programs, given as patterns in the syntax of [path.Match] matched
+	// against the absolute path of the executable (for example,
+	// "/usr/bin/ssh"). Keys restricted in this way cannot be used by peers
+	// whose executable is unknown. See also [Peer].
+	Programs []string
+
+	// ParentDepth, if positive, also permits matching keys to be used by a
+	// peer if one of its nearest ParentDepth ancestor processes runs one of
+	// the Programs. For example, with ParentDepth 1, a key restricted to a
+	// deploy tool may be used by an ssh process the tool runs.
+	ParentDepth int
+
+	// MaxStale, if non-zero, overrides Config.MaxStale for matching keys.
+	// If negative, matching keys never become stale.
+	MaxStale time.Duration
+}
+
+// applyPolicy attaches the policy for the secret holding key, if any, and
+// requires confirmation if any matching policy does.
+func (s *Server) applyPolicy(key *sshKey) {
+	if p := s.policyFor(key.Name); p != nil {
+		key.Policy = p
+	}
+	for _, p := range s.policies {
+		if ok, _ := path.Match(p.Match, key.Name); ok && p.Confirm {
+			key.Confirm = true
+			break
+		}
+	}
+}
+
+// policyFor returns the first policy matching the specified secret name, or
+// nil if no policy matches.
+func (s *Server) policyFor(name string) *KeyPolicy {
+	for i, p := range s.policies {
+		if ok, _ := path.Match(p.Match, name); ok {
+			return &s.policies[i]
+		}
+	}
+	return nil
 }
 
 // NewServer constructs a new [Server] that fetches SSH keys matching the
-// specified configuration in [setec].
+// specified configuration in [setec]. It reports an error if the
+// configuration is invalid.
 //
 // The caller must call [Server.Update] at least once to initialize the list of
 // keys available to the agent.  Thereafter, the caller may call Update again
 // as often as desired to update the list. The server does not automatically
 // perform updates.
-func NewServer(config Config) *Server {
-	if config.Prefix == "" {
-		panic("empty scret name prefix")
+func NewServer(config Config) (*Server, error) {
+	if config.Prefix == "" && len(config.Include) == 0 && len(config.Names) == 0 && config.Manifest == "" {
+		return nil, errors.New("no secret name prefix, patterns, names, or manifest")
+	}
+	include, err := parsePatterns(config.Include)
+	if err != nil {
+		return nil, err
+	}
+	if config.Prefix != "" {
+		include = append(include, prefixPattern(config.Prefix))
+	}
+	exclude, err := parsePatterns(config.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if config.Cache != nil && len(config.CacheKey) != CacheKeyLen {
+		return nil, fmt.Errorf("cache key must be %d bytes", CacheKeyLen)
+	}
+	if err := checkCommentTemplate(config.CommentTemplate); err != nil {
+		return nil, err
 	}
-	if !strings.HasSuffix(config.Prefix, "/") {
-		config.Prefix += "/"
+	for _, p := range config.Policies {
+		if _, err := path.Match(p.Match, ""); err != nil || p.Match == "" {
+			return nil, fmt.Errorf("invalid policy pattern %q", p.Match)
+		}
+		for _, prog := range p.Programs {
+			if _, err := path.Match(prog, ""); err != nil || prog == "" {
+				return nil, fmt.Errorf("invalid program pattern %q", prog)
+			}
+		}
+		for _, fp := range p.HostKeys {
+			if err := checkFingerprint(fp); err != nil {
+				return nil, err
+			}
+		}
 	}
-	return &Server{prefix: config.Prefix, setecClient: config.Client, logf: config.Logf}
+	return &Server{
+		include:     include,
+		exclude:     exclude,
+		maxDepth:    config.MaxDepth,
+		names:       slices.Clone(config.Names),
+		manifest:    config.Manifest,
+		setecClient: config.Client,
+		logf:        config.Logf,
+		allowAdd:    config.AllowAdd,
+		policies:    slices.Clone(config.Policies),
+		askpass:     config.Askpass,
+		auditf:      config.Audit,
+		strictSign:  config.StrictSign,
+		knownHosts:  slices.Clone(config.KnownHosts),
+		commentTmpl: config.CommentTemplate,
+		allowUIDs:   slices.Clone(config.AllowUIDs),
+		allowGIDs:   slices.Clone(config.AllowGIDs),
+
+		strictUpdate:      config.StrictUpdate,
+		missInterval:      config.MissUpdateInterval,
+		rotationGrace:     config.RotationGrace,
+		maxStale:          config.MaxStale,
+		cache:             config.Cache,
+		cacheKey:          bytes.Clone(config.CacheKey),
+		cacheMaxAge:       config.CacheMaxAge,
+		missOnList:        config.MissUpdateOnList,
+		updateConcurrency: cmp.Or(config.UpdateConcurrency, defaultUpdateConcurrency),
+	}, nil
 }
 
+// defaultUpdateConcurrency is the number of secrets fetched concurrently by
+// Update, if the config does not specify it.
+const defaultUpdateConcurrency = 8
+
 // Server implements the SSH key agent server protocol.  The caller must call
 // [agent.ServeAgent] to expose the server to clients.
 type Server struct {
-	prefix      string // includes trailing "/"
+	include     []namePattern
+	exclude     []namePattern
+	maxDepth    int // ≤ 0 means no limit
+	names       []string
+	manifest    string
 	setecClient setec.Client
 	logf        func(string, ...any)
+	allowAdd    bool
+	policies    []KeyPolicy
+	askpass     string
+	auditf      func(SignRecord)
+	strictSign  bool
+	knownHosts  []string
+	commentTmpl string
+	allowUIDs   []int
+	allowGIDs   []int
+
+	strictUpdate      bool
+	missInterval      time.Duration // ≤ 0 means no on-demand updates
+	rotationGrace     time.Duration // ≤ 0 means no grace period
+	missOnList        bool
+	maxStale          time.Duration // ≤ 0 means no limit
+	cache             Cache
+	cacheKey          []byte
+	cacheMaxAge       time.Duration // ≤ 0 means no limit
+	updateConcurrency int           // ≤ 0 means no limit
+
+	confirmμ sync.Mutex // serializes confirmation prompts
+	unlockμ  sync.Mutex // serializes attempts to lock and unlock
+
+	statusμ sync.Mutex
+	status  UpdateStatus
 
-	μ          sync.Mutex
-	locked     bool
-	passphrase string
-	keys       map[string]*sshKey
+	manifestμ       sync.Mutex
+	manifestVersion api.SecretVersion // the manifest version last fetched
+	manifestNames   []string          // the names listed in that version
+
+	probeμ    sync.Mutex
+	auxMissed map[string]time.Time // certificate and passphrase secrets found missing, and when
+
+	missμ    sync.Mutex // serializes on-demand updates
+	missLast time.Time  // when the last on-demand update started
+	missDone time.Time  // when the last on-demand update finished
+
+	μ        sync.Mutex
+	locked   bool
+	lockSalt []byte // random salt for lockHash
+	lockHash []byte // KDF hash of the lock passphrase
+	keys     map[string]*sshKey
+	previous map[string]*sshKey // superseded keys, during the rotation grace period
+	added    map[string]*sshKey // keys added by clients
+	sealed   []byte             // added keys, encrypted while locked
+
+	// removed records secrets whose keys were removed by a client, mapped to
+	// the version that was removed. Update does not reload these secrets until
+	// a new version is activated, or they are restored by Restore.
+	removed map[string]api.SecretVersion
 }
 
+// errLocked is reported for operations that are refused while the agent is
+// locked.
+var errLocked = errors.New("agent: locked")
+
+// errKeyNotFound is reported for requests to use a key the agent does not have.
+var errKeyNotFound = errors.New("key not found")
+
 // Serve accepts connections from lst and serve the agent to each in its own
 // goroutine. It runs until lst closes or ctx ends.
 func (s *Server) Serve(ctx context.Context, lst net.Listener) {
@@ -92,7 +447,7 @@ func (s *Server) Serve(ctx context.Context, lst net.Listener) {
 			}
 			break
 		}
-		g.Go(func() error { return s.ServeOne(conn) })
+		g.Go(func() error { defer conn.Close(); return s.ServeOne(conn) })
 	}
 	g.Wait()
 }
@@ -100,19 +455,54 @@ func (s *Server) Serve(ctx context.Context, lst net.Listener) {
 // ServeOne serves the agent to the specified connection.  It is safe to call
 // ServeOne concurrently from multiple goroutines with separate connections,
 // including while Serve is running.
-func (s *Server) ServeOne(conn io.ReadWriter) error {
-	return agent.ServeAgent(s, conn)
+//
+// Each connection tracks its own session bindings, as reported by OpenSSH
+// clients using the session-bind@openssh.com extension.
+//
+// If rw is a Unix socket, ServeOne identifies the peer from its credentials
+// where the platform supports this (SO_PEERCRED). Otherwise the peer is
+// unknown. See [Server.ServePeer].
+func (s *Server) ServeOne(rw io.ReadWriter) error {
+	return s.ServePeer(rw, s.connPeer(rw))
 }
 
 // List implements part of the [agent.Agent] interface.
-func (s *Server) List() ([]*agent.Key, error) {
+//
+// Calling List directly on the server is equivalent to calling it on a
+// connection with no session bindings.
+func (s *Server) List() ([]*agent.Key, error) { return s.list(nil) }
+
+// list lists the keys available on the connection c, which may be nil.
+func (s *Server) list(c *conn) ([]*agent.Key, error) {
+	begin := time.Now()
+	keys, err := s.listOnce(c)
+	if err == nil && len(keys) == 0 && s.missOnList && !s.isLocked() && s.updateOnMiss(begin) {
+		return s.listOnce(c) // try again with the updated keys
+	}
+	return keys, err
+}
+
+// listOnce implements list, without updating on a miss.
+func (s *Server) listOnce(c *conn) ([]*agent.Key, error) {
+	binds, peer := c.bindings(), c.peerInfo()
 	s.μ.Lock()
 	defer s.μ.Unlock()
-	if s.locked || len(s.keys) == 0 {
+	if s.locked {
 		return nil, nil // locked agents return an empty list
 	}
-	keys := make([]*agent.Key, 0, len(s.keys))
-	for _, key := range s.keys {
+	now := time.Now()
+	var keys []*agent.Key
+	for _, key := range s.eachKeyLocked(now) {
+		if s.checkUse(key, binds, peer, nil) != nil {
+			continue // not permitted on this connection
+		}
+		if key.certValid(now) {
+			keys = append(keys, &agent.Key{
+				Format:  key.Cert.Type(),
+				Blob:    key.Cert.Marshal(),
+				Comment: key.Comment,
+			})
+		}
 		keys = append(keys, &agent.Key{
 			Format:  key.Signer.PublicKey().Type(),
 			Blob:    key.Signer.PublicKey().Marshal(),
@@ -123,136 +513,711 @@ func (s *Server) List() ([]*agent.Key, error) {
 }
 
 // Sign implements part of the [agent.Agent] interface.
+// Signing is refused while the agent is locked.
 func (s *Server) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags implements part of the [agent.ExtendedAgent] interface.
+//
+// Calling SignWithFlags directly on the server is equivalent to calling it on
+// a connection with no session bindings.
+func (s *Server) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return s.sign(nil, key, data, flags)
+}
+
+// sign signs data with the specified key on behalf of the connection c,
+// which may be nil.
+func (s *Server) sign(c *conn, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	begin := time.Now()
+	sk, err := s.signingKey(key)
+	if errors.Is(err, errKeyNotFound) && s.updateOnMiss(begin) {
+		sk, err = s.signingKey(key) // try again with the updated keys
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := newSignRecord(sk, data)
+	rec.Peer = c.peerInfo()
+	if rec.Kind == DataUnknown && s.strictSign {
+		s.logPrintf("Refused to sign unrecognized data with key %s", rec.Fingerprint)
+		return nil, errors.New("agent: refusing to sign unrecognized data")
+	}
+	if err := s.checkUse(sk, c.bindings(), rec.Peer, &rec); err != nil {
+		s.logPrintf("Refused to sign with key %s: %v", rec.Fingerprint, err)
+		return nil, err
+	}
+	if sk.Confirm {
+		if err := s.confirmUse(sk, rec.Peer); err != nil {
+			return nil, err
+		}
+	}
+	// A signature made with a certificate is the same as one made with the
+	// underlying key, so we can use the key's signer for either.
+	sig, err := signWithFlags(sk.Signer, data, flags)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(rec)
+	return sig, nil
+}
+
+// checkUse reports an error if the policy for sk does not permit its use on a
+// connection with the given session bindings and peer. If rec != nil, it
+// describes the data to be signed; otherwise the check is for listing keys.
+func (s *Server) checkUse(sk *sshKey, binds []sessionBind, peer *Peer, rec *SignRecord) error {
+	for _, p := range []*KeyPolicy{sk.Policy, sk.Limits} {
+		if err := s.checkDestination(p, binds, rec); err != nil {
+			return err
+		}
+	}
+	return checkProgram(sk.Policy, peer)
+}
+
+// signingKey returns the key matching the specified public key, if the agent
+// is unlocked and such a key is available.
+func (s *Server) signingKey(key ssh.PublicKey) (*sshKey, error) {
 	s.μ.Lock()
 	defer s.μ.Unlock()
-	sk, ok := s.keys[publicKeyID(key)]
+	if s.locked {
+		return nil, errLocked
+	}
+	_, sk, ok := s.findKeyLocked(key)
 	if !ok {
-		return nil, errors.New("key not found")
+		return nil, errKeyNotFound
+	}
+	return sk, nil
+}
+
+// confirmUse reports whether the user confirms the use of sk for signing on
+// behalf of peer, which may be nil, by running the askpass program.
+func (s *Server) confirmUse(sk *sshKey, peer *Peer) error {
+	if s.askpass == "" {
+		return errors.New("agent: key requires confirmation, but no askpass program is configured")
+	}
+	s.confirmμ.Lock()
+	defer s.confirmμ.Unlock()
+
+	fp := ssh.FingerprintSHA256(sk.Signer.PublicKey())
+	var prompt string
+	if sk.Name == "" {
+		prompt = fmt.Sprintf("Allow use of added key %q?\nKey fingerprint %s.", sk.Comment, fp)
+	} else {
+		prompt = fmt.Sprintf("Allow use of key %q from secret %q?\nKey fingerprint %s.", sk.Comment, sk.Name, fp)
+	}
+	if peer != nil {
+		prompt += fmt.Sprintf("\nRequested by %s.", peer)
+	} else {
+		prompt += "\nRequested by an unknown process."
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.askpass, prompt)
+	cmd.Env = append(os.Environ(),
+		"SSH_ASKPASS_PROMPT=confirm",
+		"TSKAGENT_SECRET_NAME="+sk.Name,
+		"TSKAGENT_KEY_COMMENT="+sk.Comment,
+		"TSKAGENT_KEY_FINGERPRINT="+fp,
+	)
+	if peer != nil {
+		cmd.Env = append(cmd.Env,
+			"TSKAGENT_PEER_PID="+strconv.Itoa(peer.PID),
+			"TSKAGENT_PEER_UID="+strconv.Itoa(peer.UID),
+			"TSKAGENT_PEER_EXE="+peer.Exe,
+		)
+	}
+	if err := cmd.Run(); err != nil {
+		s.logPrintf("Use of key %s was not confirmed: %v", fp, err)
+		return errors.New("agent: use of key was not confirmed")
+	}
+	s.logPrintf("Use of key %s was confirmed", fp)
+	return nil
+}
+
+// confirmTimeout bounds the time the agent waits for the user to confirm the
+// use of a key.
+const confirmTimeout = 2 * time.Minute
+
+// findKeyLocked returns the ID and the key matching the specified public key,
+// which may be either a plain key or a currently-valid certificate for a key.
+// The caller must hold s.μ.
+func (s *Server) findKeyLocked(key ssh.PublicKey) (string, *sshKey, bool) {
+	want := publicKeyID(key)
+	now := time.Now()
+	for id, sk := range s.eachKeyLocked(now) {
+		if id == want || (sk.certValid(now) && publicKeyID(sk.Cert) == want) {
+			return id, sk, true
+		}
 	}
-	return sk.Signer.Sign(rand.Reader, data)
+	return "", nil, false
+}
+
+// eachKeyLocked returns an iterator over the keys served by the agent at now,
+// and their IDs: first the valid keys from the secrets service that are not
+// stale, in order of priority, then the superseded keys still within their
+// grace period, then the unexpired keys added by clients. The caller must
+// hold s.μ.
+func (s *Server) eachKeyLocked(now time.Time) iter.Seq2[string, *sshKey] {
+	return func(yield func(string, *sshKey) bool) {
+		ids := slices.SortedFunc(maps.Keys(s.keys), func(a, b string) int {
+			ka, kb := s.keys[a], s.keys[b]
+			return cmp.Or(cmp.Compare(kb.Priority, ka.Priority), cmp.Compare(ka.Name, kb.Name), cmp.Compare(a, b))
+		})
+		for _, id := range ids {
+			sk := s.keys[id]
+			if !sk.validAt(now) || s.isStale(sk, now) {
+				continue
+			}
+			if !yield(id, sk) {
+				return
+			}
+		}
+		for id, sk := range s.previous {
+			if !sk.validAt(now) || s.isStale(sk, now) {
+				continue
+			}
+			if !yield(id, sk) {
+				return
+			}
+		}
+		for id, sk := range s.added {
+			if sk.expired(now) {
+				continue
+			}
+			if !yield(id, sk) {
+				return
+			}
+		}
+	}
+}
+
+// Extension implements part of the [agent.ExtendedAgent] interface.
+// This implementation does not currently support any extensions.
+func (s *Server) Extension(extensionType string, contents []byte) ([]byte, error) {
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	if s.locked {
+		return nil, errLocked
+	}
+	return nil, agent.ErrExtensionUnsupported
 }
 
 // Add implements part of the [agent.Agent] interface.
-// This implementation does not support adding keys.
+//
+// Adding keys is supported only if the server was constructed with AllowAdd
+// set. Added keys are held in memory, and are never written to the secrets
+// service. The lifetime and confirmation constraints are supported. A key
+// that the agent serves from the secrets service cannot also be added, and
+// an added key is discarded if an update later finds it in the secrets
+// service.
 func (s *Server) Add(key agent.AddedKey) error {
-	return errors.New("agent: adding keys is not supported")
+	if !s.allowAdd {
+		return errors.New("agent: adding keys is not supported")
+	} else if len(key.ConstraintExtensions) != 0 {
+		return fmt.Errorf("agent: unsupported key constraint %q", key.ConstraintExtensions[0].ExtensionName)
+	}
+	sk, err := newAddedKey(key, time.Now())
+	if err != nil {
+		return fmt.Errorf("agent: %w", err)
+	}
+
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	if s.locked {
+		return errLocked
+	}
+	id := sk.mapID()
+	if s.keys[id] != nil || s.previous[id] != nil {
+		return errors.New("agent: key is already provided by the secrets service")
+	}
+	if s.added == nil {
+		s.added = make(map[string]*sshKey)
+	}
+	s.added[id] = sk
+	if !sk.Expires.IsZero() {
+		time.AfterFunc(time.Until(sk.Expires), s.pruneAdded)
+	}
+	s.logPrintf("Added key %s (%q)", ssh.FingerprintSHA256(sk.Signer.PublicKey()), sk.Comment)
+	return nil
 }
 
 // Remove implements part of the [agent.Agent] interface.
 //
 // This implementation only removes the key from the local list, it does not
-// affect what is stored on the secrets server.
+// affect what is stored on the secrets server. The key remains removed across
+// updates until a new version of its secret is activated, or until it is
+// restored by a call to [Server.Restore].
 func (s *Server) Remove(key ssh.PublicKey) error {
 	s.μ.Lock()
 	defer s.μ.Unlock()
-	id := publicKeyID(key)
-	if _, ok := s.keys[id]; !ok {
+	if s.locked {
+		return errLocked
+	}
+	id, sk, ok := s.findKeyLocked(key)
+	if !ok {
 		return errors.New("agent: key not found")
 	}
-	delete(s.keys, id)
+	s.removeLocked(id, sk)
 	return nil
 }
 
 // RemoveAll implements part of the [agent.Agent] interface.
 //
 // This implementation only removes keys from the local list, it does not
-// affect what is stored on the secrets server.
+// affect what is stored on the secrets server. As with Remove, the keys remain
+// removed across updates.
 func (s *Server) RemoveAll() error {
 	s.μ.Lock()
 	defer s.μ.Unlock()
-	clear(s.keys)
+	if s.locked {
+		return errLocked
+	}
+	for id, sk := range s.keys {
+		s.removeLocked(id, sk)
+	}
+	clear(s.previous)
+	clear(s.added)
 	return nil
 }
 
+// removeLocked removes the specified key. For a key from the secrets service,
+// it also records a tombstone for its secret version. The caller must hold s.μ.
+func (s *Server) removeLocked(id string, sk *sshKey) {
+	if sk.Name == "" {
+		delete(s.added, id)
+		s.logPrintf("Removed added key %s", ssh.FingerprintSHA256(sk.Signer.PublicKey()))
+		return
+	} else if s.previous[id] == sk {
+		delete(s.previous, id)
+		s.logPrintf("Removed superseded %q version %d", sk.Name, sk.Version)
+		return
+	} else if s.removed == nil {
+		s.removed = make(map[string]api.SecretVersion)
+	}
+	s.removed[sk.Name] = sk.Version
+	delete(s.keys, id)
+	s.logPrintf("Removed %q version %d", sk.Name, sk.Version)
+}
+
+// Restore discards the records of keys removed from the agent by clients for
+// the specified secret names, and then calls Update to reload them. If no
+// names are given, all removed keys are restored.
+func (s *Server) Restore(ctx context.Context, names ...string) error {
+	s.μ.Lock()
+	if len(names) == 0 {
+		clear(s.removed)
+	}
+	for _, name := range names {
+		delete(s.removed, name)
+	}
+	s.μ.Unlock()
+	_, err := s.Update(ctx)
+	return err
+}
+
 // Lock implements part of the [agent.Agent] interface.
+//
+// While the agent is locked, all operations other than Unlock are refused,
+// and List reports no keys. Locking the agent discards the key material it
+// holds: Keys from the secrets service are fetched again on Unlock, and keys
+// added by clients are kept only in encrypted form until Unlock.
 func (s *Server) Lock(passphrase []byte) error {
+	// As in unlock, derive the keys without holding s.μ, but one at a time.
+	// Only Lock and unlock change s.locked, and both hold unlockμ, so it does
+	// not change before the lock is applied.
+	s.unlockμ.Lock()
+	defer s.unlockμ.Unlock()
+	if s.isLocked() {
+		return errors.New("agent: already locked")
+	}
+	salt := make([]byte, lockSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("agent: generate salt: %w", err)
+	}
+	check, sealKey := deriveLockKeys(passphrase, salt)
+
 	s.μ.Lock()
 	defer s.μ.Unlock()
-	if s.locked {
-		return errors.New("agent: already locked")
+	sealed, err := sealAddedKeys(sealKey, s.added)
+	if err != nil {
+		return fmt.Errorf("agent: seal added keys: %w", err)
 	}
 	s.locked = true
-	s.passphrase = string(passphrase)
+	s.lockSalt = salt
+	s.lockHash = check
+	s.sealed = sealed
+	s.keys, s.previous, s.added = nil, nil, nil
 	s.logPrintf("Agent is now locked")
 	return nil
 }
 
 // Unlock implements part of the [agent.Agent] interface.
+//
+// A successful Unlock reloads keys from the secrets service. Failure to reload
+// is logged but does not prevent the agent from being unlocked.
 func (s *Server) Unlock(passphrase []byte) error {
+	if err := s.unlock(passphrase); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), unlockUpdateTimeout)
+	defer cancel()
+	if _, err := s.Update(ctx); err != nil {
+		s.logPrintf("WARNING: Reloading keys after unlock failed: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) unlock(passphrase []byte) error {
+	// Derive the keys without holding s.μ, so that other operations are not
+	// blocked while a client tries passphrases. Attempts are serialized, to
+	// bound the memory used by the KDF.
+	s.unlockμ.Lock()
+	defer s.unlockμ.Unlock()
 	s.μ.Lock()
-	defer s.μ.Unlock()
-	if !s.locked {
+	locked, salt, hash := s.locked, s.lockSalt, s.lockHash
+	s.μ.Unlock()
+	if !locked {
 		return errors.New("agent: not locked")
-	} else if subtle.ConstantTimeCompare(passphrase, []byte(s.passphrase)) == 0 {
+	}
+	check, sealKey := deriveLockKeys(passphrase, salt)
+	if subtle.ConstantTimeCompare(check, hash) == 0 {
 		return errors.New("agent: incorrect passphrase")
 	}
+
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	if !s.locked || !bytes.Equal(s.lockSalt, salt) {
+		return errors.New("agent: lock state changed during unlock")
+	}
+	added, err := openAddedKeys(sealKey, s.sealed)
+	if err != nil {
+		return fmt.Errorf("agent: restore added keys: %w", err)
+	}
 	s.locked = false
-	s.passphrase = ""
+	s.lockSalt, s.lockHash, s.sealed = nil, nil, nil
+	s.added = added
+	s.pruneAddedLocked(time.Now())
 	s.logPrintf("Agent is now unlocked")
 	return nil
 }
 
+const (
+	lockSaltLen = 16 // bytes of salt for the lock passphrase
+
+	// unlockUpdateTimeout bounds the time Unlock waits to reload keys.
+	unlockUpdateTimeout = 30 * time.Second
+)
+
+// deriveLockKeys derives a check hash and an encryption key from passphrase
+// and salt, using Argon2id. The check hash is retained to verify the
+// passphrase on unlock; the encryption key is not.
+func deriveLockKeys(passphrase, salt []byte) (check, sealKey []byte) {
+	k := argon2.IDKey(passphrase, salt, 1, 64*1024, 4, 64)
+	return k[:32], k[32:]
+}
+
 // Signers implements part of the [agent.Agent] interface.
 func (s *Server) Signers() ([]ssh.Signer, error) {
 	s.μ.Lock()
 	defer s.μ.Unlock()
-	out := make([]ssh.Signer, 0, len(s.keys))
-	for _, key := range s.keys {
+	if s.locked {
+		return nil, errLocked
+	}
+	now := time.Now()
+	var out []ssh.Signer
+	for _, key := range s.eachKeyLocked(now) {
+		if key.certValid(now) {
+			cs, err := ssh.NewCertSigner(key.Cert, key.Signer)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cs)
+		}
 		out = append(out, key.Signer)
 	}
 	return out, nil
 }
 
-// Update attempts to update the list of keys from the secrets service.
-// It is safe to call Update concurrently with client access.
-// In case of error, the existing list of keys is not modified.
-func (s *Server) Update(ctx context.Context) error {
-	ss, err := s.setecClient.List(ctx)
+// Update attempts to update the list of keys from the secrets service, and
+// reports what it changed. It is safe to call Update concurrently with client
+// access. While the agent is locked, Update does nothing.
+//
+// If some secrets cannot be fetched, Update reports an error, and the result
+// lists the failures. By default, Update still applies the secrets that were
+// fetched successfully, and keeps the previous keys (if any) for secrets that
+// failed. If Config.StrictUpdate is set, Update instead leaves the existing
+// list of keys unmodified unless all secrets are fetched successfully.
+//
+// If the secrets cannot be listed, Update reports an error and a nil result,
+// and the existing list of keys is not modified.
+//
+// The outcome of each update is recorded in the status reported by
+// [Server.UpdateStatus].
+func (s *Server) Update(ctx context.Context) (*UpdateResult, error) {
+	if s.isLocked() {
+		s.logPrintf("[update] agent is locked; skipping update")
+		return new(UpdateResult), nil
+	}
+	start := time.Now()
+	res, err := s.update(ctx)
+	s.recordUpdate(start, res, err)
 	if err != nil {
-		return err
+		s.logStaleness()
 	}
-	found := make(map[string]api.SecretVersion)
-	for _, sec := range ss {
-		if !strings.HasPrefix(sec.Name, s.prefix) {
-			continue // wrong prefix, skip this one
+	// A partial update is worth saving: The keys it could not fetch keep the
+	// times they were last confirmed current. But if it has no keys for some
+	// of the secrets, saving it would discard them from the cache.
+	partial := err != nil && res != nil && !s.strictUpdate && len(res.Missing) == 0
+	if (err == nil || partial) && s.cache != nil {
+		if err := s.saveCache(start); err != nil {
+			s.logPrintf("WARNING: Saving key cache failed: %v", err)
 		}
-		found[sec.Name] = sec.ActiveVersion
 	}
+	return res, err
+}
+
+// update implements Update, without recording its status.
+func (s *Server) update(ctx context.Context) (*UpdateResult, error) {
+	begin := time.Now()
+	set, err := s.selectSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := set.keys
+	have := s.fillKnown(set)
 
-	have := s.fillKnown(found)
+	// Fetch the remaining secrets concurrently. In strict mode, the first
+	// failure cancels the rest, since their results will not be used.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var haveμ sync.Mutex
+	failed := set.failed
+	if s.strictUpdate && len(failed) != 0 {
+		found = nil // no point fetching the rest
+	}
+	g, start := taskgroup.New(nil).Limit(s.updateConcurrency)
 	for name := range found {
-		sec, err := s.setecClient.Get(ctx, name)
-		if err != nil {
-			return fmt.Errorf("get %q: %w", name, err)
-		}
-		s.logPrintf("[update] fetched %q version %d", name, sec.Version)
-		key, err := parseStoredKey(name, sec.Version, sec.Value)
-		if err != nil {
-			s.logPrintf("[update] WARNING: skipped invalid key %q (%v)", name, err)
-			continue
+		if _, ok := failed[name]; ok {
+			continue // keep what we have
 		}
-		have[key.mapID()] = key
+		start(func() error {
+			keys, err := s.fetchKeys(ctx, set, name)
+			haveμ.Lock()
+			defer haveμ.Unlock()
+			if err != nil {
+				if s.strictUpdate {
+					if len(failed) != 0 && errors.Is(err, context.Canceled) {
+						return nil // canceled by an earlier failure
+					}
+					cancel()
+				}
+				failed[name] = err
+			}
+			for _, key := range keys {
+				have[key.mapID()] = key
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	res := &UpdateResult{Failed: failed}
+	if len(failed) != 0 && s.strictUpdate {
+		s.logPrintf("[update] %d secrets failed; keeping existing keys", len(failed))
+		return res, res.Err()
 	}
 
 	s.μ.Lock()
 	defer s.μ.Unlock()
+	if s.locked {
+		// The agent was locked while we were fetching; discard the results.
+		return new(UpdateResult), nil
+	}
+	for id, key := range have {
+		// A client may have removed a key while we were fetching.
+		if v, ok := s.removed[key.Name]; ok && v == key.Version && s.keys[id] == nil {
+			delete(have, id)
+		}
+	}
+	for _, key := range have {
+		key.Checked = begin // confirmed current as of this update
+	}
+	kept := make(map[string]bool)
+	for id, key := range s.keys {
+		// Keep the previous keys for secrets we could not fetch.
+		if _, ok := failed[key.Name]; ok {
+			have[id] = key
+			kept[key.Name] = true
+		}
+	}
+	for name := range failed {
+		if _, ok := s.removed[name]; !ok && !kept[name] {
+			res.Missing = append(res.Missing, name)
+		}
+	}
+	slices.Sort(res.Missing)
+	res.diff(s.keys, have)
+	s.supersedeLocked(have, time.Now())
+	s.dropAddedLocked(have)
 	s.keys = have
+	s.logPrintf("[update] %s", res)
+	return res, res.Err()
+}
+
+// fetchKeys fetches the keys stored in the named secret, along with its
+// certificate if set lists one, and its passphrase if the keys are encrypted.
+// If the secret does not contain valid keys, fetchKeys logs and skips it,
+// returning nil without error.
+func (s *Server) fetchKeys(ctx context.Context, set *secretSet, name string) ([]*sshKey, error) {
+	sec, err := s.getVersion(ctx, set, name, set.keys[name])
+	if err != nil {
+		return nil, err
+	}
+	s.logPrintf("[update] fetched %q version %d", name, sec.Version)
+	pname := name + passphraseSuffix
+	passVersion := set.passphrases[pname]
+	keys, err := parseStoredKeys(name, sec.Version, sec.Value, nil)
+	if isPassphraseMissing(err) {
+		var pass *api.SecretValue
+		if named := passphraseName(sec.Value); named != "" {
+			// A passphrase secret named by an envelope is not selected, so
+			// we do not know its version; use the active one.
+			pname = named
+			pass, err = s.setecClient.Get(ctx, pname)
+			if err != nil {
+				return nil, fmt.Errorf("get %q: %w", pname, err)
+			}
+		} else if passVersion != 0 {
+			pass, err = s.getVersion(ctx, set, pname, passVersion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if pass != nil {
+			s.logPrintf("[update] fetched %q version %d", pname, pass.Version)
+			passVersion = pass.Version
+			keys, err = parseStoredKeys(name, sec.Version, sec.Value, pass.Value)
+		}
+	}
+	if err != nil {
+		s.logPrintf("[update] WARNING: skipped invalid key %q (%v)", name, err)
+		return nil, nil
+	}
+	for _, key := range keys {
+		key.PassVersion = passVersion
+		s.applyComment(key)
+		s.applyPolicy(key)
+	}
+	if cname := name + certSuffix; set.certs[cname] != 0 {
+		if err := s.fetchCert(ctx, set, cname, keys); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// fetchCert fetches the certificate stored in the named secret and attaches
+// it to the key it certifies among keys. Only errors fetching the secret are
+// reported; if the secret does not contain a certificate for one of the keys,
+// fetchCert logs and skips the certificate, and the keys are offered without
+// it. A certificate that is expired or not yet valid is attached, but offered
+// only while it is valid, so that it need not be fetched again unless the
+// secret changes.
+func (s *Server) fetchCert(ctx context.Context, set *secretSet, name string, keys []*sshKey) error {
+	sec, err := s.getVersion(ctx, set, name, set.certs[name])
+	if err != nil {
+		return err
+	}
+	s.logPrintf("[update] fetched %q version %d", name, sec.Version)
+	for _, key := range keys {
+		key.CertVersion = sec.Version
+	}
+	cert, err := parseCertOnly(sec.Value)
+	if err == nil {
+		err = errors.New("certificate does not match the key")
+		for _, key := range keys {
+			if bytes.Equal(cert.Key.Marshal(), key.Signer.PublicKey().Marshal()) {
+				key.Cert = cert
+				if err = checkCertTime(cert, time.Now()); err != nil {
+					s.logPrintf("[update] WARNING: certificate %q is not currently valid (%v)", name, err)
+					err = nil
+				}
+				break
+			}
+		}
+	}
+	if err != nil {
+		s.logPrintf("[update] WARNING: skipped certificate %q (%v)", name, err)
+	}
 	return nil
 }
 
-// fillKnown returns a map of those secrets listed in found that are already
-// resident in the local cache with the same version. The secrets reported in
-// the result are removed from found.
-func (s *Server) fillKnown(found map[string]api.SecretVersion) map[string]*sshKey {
+func (s *Server) isLocked() bool {
 	s.μ.Lock()
 	defer s.μ.Unlock()
+	return s.locked
+}
+
+// fillKnown returns a map of the keys from those key secrets listed in set
+// whose keys are already resident in the local cache with the same version,
+// and the same versions of a valid certificate and a passphrase (if any)
+// listed in set. The keys bundled in a secret are kept or replaced together.
+// The secrets reported in the result are removed from set.keys, as are any
+// secrets whose keys were removed by a client at the same version.
+func (s *Server) fillKnown(set *secretSet) map[string]*sshKey {
+	found, certs := set.keys, set.certs
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	tomb := make(map[string]bool)
+	for name, v := range s.removed {
+		if fv, ok := found[name]; !ok || fv != v {
+			delete(s.removed, name) // deleted or updated; forget the tombstone
+			continue
+		}
+		tomb[name] = true
+		delete(found, name)
+		s.logPrintf("[update] skip removed %q version %d", name, v)
+	}
+
+	// Check each secret whose keys we have.
+	type check struct {
+		version api.SecretVersion
+		n, size int  // the number of keys we have, and in the secret
+		changed bool // the secret, certificate, or passphrase changed
+	}
+	checks := make(map[string]*check)
+	for _, key := range s.keys {
+		c := checks[key.Name]
+		if c == nil {
+			c = &check{version: key.Version, size: key.Bundle}
+			checks[key.Name] = c
+		}
+		c.n++
+		if found[key.Name] != key.Version && !tomb[key.Name] {
+			c.changed = true // added, removed, or changed
+		} else if key.PassName == "" && key.PassVersion != set.passphrases[key.Name+passphraseSuffix] {
+			c.changed = true // passphrase added, removed, or changed
+		} else if key.CertVersion != certs[key.Name+certSuffix] {
+			c.changed = true // certificate added, removed, or changed
+		}
+	}
+	keep := make(map[string]bool)
+	for name, c := range checks {
+		if c.changed {
+			continue // check the secret again
+		} else if c.n < c.size && !tomb[name] {
+			continue // some of the bundled keys were restored
+		}
+		keep[name] = true
+		delete(found, name)
+		if !tomb[name] {
+			s.logPrintf("[update] keep %q version %d", name, c.version)
+		}
+	}
 	out := make(map[string]*sshKey)
 	for id, key := range s.keys {
-		if v, ok := found[key.Name]; ok && v == key.Version {
+		if keep[key.Name] {
 			out[id] = key
-			delete(found, key.Name)
-			s.logPrintf("[update] keep %q version %d", key.Name, key.Version)
 		}
 	}
 	return out
@@ -265,10 +1230,73 @@ func (s *Server) logPrintf(msg string, args ...any) {
 }
 
 type sshKey struct {
-	Name    string            // secret name in setec
+	Name    string            // secret name in setec; "" for added keys
 	Version api.SecretVersion // latest version
 	Signer  ssh.Signer        // the private (signing) key
 	Comment string            // if provided, the public key comment
+
+	Cert        *ssh.Certificate  // if non-nil, a certificate for the key (see certValid)
+	CertVersion api.SecretVersion // if non-zero, the certificate secret version
+	PassVersion api.SecretVersion // if non-zero, the passphrase secret version
+	PassName    string            // if set, the passphrase secret named by the envelope
+
+	Checked   time.Time         // when the key was last confirmed current in setec
+	Policy    *KeyPolicy        // if non-nil, the usage policy for the key
+	Limits    *KeyPolicy        // if non-nil, restrictions from the envelope
+	Confirm   bool              // whether each use must be confirmed
+	NotBefore time.Time         // if non-zero, when the key becomes valid
+	Expires   time.Time         // if non-zero, when the key expires
+	Bundle    int               // the number of keys stored in the secret
+	Priority  int               // keys with higher priority are listed first
+	Labels    map[string]string // metadata from the envelope
+	Data      []byte            // the PEM-encoded private key, or its envelope
+}
+
+// expired reports whether s has an expiration time that is not after now.
+func (s *sshKey) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+// validAt reports whether now is within the validity period of s.
+func (s *sshKey) validAt(now time.Time) bool {
+	return !s.expired(now) && !now.Before(s.NotBefore)
+}
+
+// certSuffix is the name suffix of a secret holding a certificate for the key
+// stored in the secret whose name is the prefix before the suffix.
+const certSuffix = "-cert.pub"
+
+// passphraseSuffix is the name suffix of a secret holding the passphrase for
+// the encrypted key stored in the secret whose name is the prefix before the
+// suffix.
+const passphraseSuffix = ".passphrase"
+
+// certValid reports whether s has a certificate that is valid at now.
+func (s *sshKey) certValid(now time.Time) bool {
+	return s.Cert != nil && checkCertTime(s.Cert, now) == nil
+}
+
+// signWithFlags signs data with signer, using the signature algorithm
+// selected by flags. As in OpenSSH, the RSA algorithm flags are ignored for
+// keys of other types.
+func signWithFlags(signer ssh.Signer, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if flags == 0 || signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer.Sign(rand.Reader, data)
+	}
+	as, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("agent: signer %T does not support algorithm selection", signer)
+	}
+	var algo string
+	switch {
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		algo = ssh.KeyAlgoRSASHA512
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		algo = ssh.KeyAlgoRSASHA256
+	default:
+		return nil, fmt.Errorf("agent: unsupported signature flags %d", flags)
+	}
+	return as.SignWithAlgorithm(rand.Reader, data, algo)
 }
 
 func publicKeyID(key ssh.PublicKey) string {
@@ -280,78 +1308,167 @@ func (s *sshKey) mapID() string {
 	return publicKeyID(s.Signer.PublicKey())
 }
 
-// parseStoredKey parses the stored version of a secret from data.
-// The contents must be a PEM formatted OpenSSH private key in one of
-// the supported key formats (RSA, ED25519, DSA, etc.).
-func parseStoredKey(name string, version api.SecretVersion, data []byte) (*sshKey, error) {
-	signer, err := ssh.ParsePrivateKey(data)
+// parseStoredKey parses the stored version of a secret from data. The
+// contents must be either a PEM formatted OpenSSH private key in one of the
+// supported key formats (RSA, ED25519, DSA, etc.), or an [Envelope] holding
+// such a key. If the key is encrypted, passphrase must be its passphrase.
+// The Data field of the result holds data, with the key decrypted.
+func parseStoredKey(name string, version api.SecretVersion, data, passphrase []byte) (*sshKey, error) {
+	if !isEnvelope(data) {
+		key, err := parsePrivateKey(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		key.Name, key.Version = name, version
+		return key, nil
+	}
+	env, err := parseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey([]byte(env.Key), passphrase)
 	if err != nil {
 		return nil, err
 	}
+	key.Name, key.Version = name, version
+	if err := env.apply(key); err != nil {
+		return nil, err
+	}
+	// The stored key is decrypted, so it no longer needs its passphrase.
+	env.Key, env.Passphrase = string(key.Data), ""
+	key.Data, err = json.Marshal(env)
+	return key, err
+}
 
-	// Now we know data was a valid PEM-formatted key, grobble around for the comment.
-	return &sshKey{
-		Name:    name,
-		Version: version,
-		Signer:  signer,
-		Comment: parseComment(data),
-	}, nil
+// parseStoredKeys parses the keys stored in a version of a secret from data,
+// which may be a bundle of several keys (see splitBundle). If the keys are
+// encrypted, passphrase must be their passphrase. It reports an error if any
+// of the keys is invalid.
+func parseStoredKeys(name string, version api.SecretVersion, data, passphrase []byte) ([]*sshKey, error) {
+	parts, err := splitBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*sshKey, len(parts))
+	for i, part := range parts {
+		key, err := parseStoredKey(name, version, part, passphrase)
+		if err != nil {
+			if len(parts) == 1 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("key %d of %d: %w", i+1, len(parts), err)
+		}
+		key.Bundle = len(parts)
+		keys[i] = key
+	}
+	return keys, nil
 }
 
-// parseComment extracts the public key comment field from the PEM-encoded key.
-// It returns "" if no comment could be found.
-func parseComment(key []byte) string {
-	blk, _ := pem.Decode(key)
+// splitBundle splits the value of a key secret into the values of the keys it
+// bundles. A bundle is either a JSON array of envelopes, or a sequence of
+// concatenated PEM blocks. Any other value is returned unsplit.
+func splitBundle(data []byte) ([][]byte, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var envs []json.RawMessage
+		if err := json.Unmarshal(data, &envs); err != nil {
+			return nil, fmt.Errorf("invalid envelope array: %w", err)
+		} else if len(envs) == 0 {
+			return nil, errors.New("empty envelope array")
+		}
+		parts := make([][]byte, len(envs))
+		for i, env := range envs {
+			parts[i] = env
+		}
+		return parts, nil
+	}
+	var parts [][]byte
+	for rest := data; ; {
+		var blk *pem.Block
+		blk, rest = pem.Decode(rest)
+		if blk == nil {
+			break
+		}
+		parts = append(parts, pem.EncodeToMemory(blk))
+	}
+	if len(parts) <= 1 {
+		return [][]byte{data}, nil
+	}
+	return parts, nil
+}
 
-	// See: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
-	s := newScanner(blk.Bytes)
+// parsePrivateKey parses a PEM formatted OpenSSH private key from data. If
+// passphrase != nil, the key is decrypted with it, ignoring a single trailing
+// newline in the passphrase. The Data field of the result holds the key, in
+// PEM format, decrypted.
+//
+// The comment of an encrypted key is stored in its encrypted section, which
+// x/crypto/ssh does not expose, so a decrypted key has no comment.
+func parsePrivateKey(data, passphrase []byte) (*sshKey, error) {
+	if passphrase == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
 
-	// Check magic format header.
-	if err := s.scanLiteral("openssh-key-v1\x00"); err != nil {
-		return "" // not a key file, or some antique version
+		// Now we know data was a valid PEM-formatted key, find its comment.
+		comment, err := parseComment(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file: %w", err)
+		}
+		return &sshKey{Signer: signer, Comment: comment, Data: data}, nil
 	}
-	cipher, err := s.scanString()
-	if err != nil || string(cipher) != "none" {
-		return "" // encrypted contents, we can't read them
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(data, bytes.TrimSuffix(passphrase, []byte("\n")))
+	if err != nil {
+		return nil, err
 	}
-	// Skip kdfname, kdfoptions, which we don't care about.
-	if err := s.skipStrings(2); err != nil {
-		return ""
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
 	}
-	// The next field is the number of keys. This could in theory be any value,
-	// but OpenSSH hardcodes it to 1.
-	if nk, err := s.scanUint32(); err != nil || nk != 1 {
-		return ""
+	blk, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return nil, err
 	}
-	// Skip the public keys, as the comment (if any) is with the private key.
-	if err := s.skipStrings(1); err != nil {
-		return ""
+	return &sshKey{Signer: signer, Data: pem.EncodeToMemory(blk)}, nil
+}
+
+// parseCert parses an OpenSSH certificate in authorized_keys format from data,
+// and checks that it certifies key. It does not check the validity period.
+func parseCert(data []byte, key ssh.PublicKey) (*ssh.Certificate, error) {
+	cert, err := parseCertOnly(data)
+	if err != nil {
+		return nil, err
 	}
+	if !bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+		return nil, errors.New("certificate does not match the key")
+	}
+	return cert, nil
+}
 
-	// The rest of the packet should be a bundle of private keys.
-	// Because we know cipher is "none", it is plaintext, but there may
-	// be some padding at the end.
-	pkeys, err := s.scanString()
+// parseCertOnly parses an OpenSSH certificate in authorized_keys format from
+// data, without checking its key or validity period.
+func parseCertOnly(data []byte) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
 	if err != nil {
-		return ""
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("got %s key, not a certificate", pub.Type())
 	}
+	return cert, nil
+}
 
-	pk := newScanner(pkeys)
-	// Skip the two 32-bit validity nonces.
-	if err := pk.skipBytes(8); err != nil {
-		return ""
+// checkCertTime reports an error if cert is expired or not yet valid at now.
+func checkCertTime(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("certificate is not valid until %v", time.Unix(int64(cert.ValidAfter), 0))
 	}
-	// The rest of the bundle depends on what type of key this is, but
-	// the last string field will be the comment (if any).
-	var last string
-	for !pk.atEOF() {
-		s, err := pk.scanString()
-		if err != nil {
-			break
-		}
-		last = string(s)
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate expired at %v", time.Unix(int64(cert.ValidBefore), 0))
 	}
-	return last
+	return nil
 }
 
 // A scanner is a minimal scanner for a slice of bytes representing an OpenSSH
@@ -387,6 +1504,16 @@ func (s *scanner) skipStrings(n int) error {
 	return nil
 }
 
+// scanByte consumes and returns a single byte.
+func (s *scanner) scanByte() (byte, error) {
+	if len(s.buf) == 0 {
+		return 0, errors.New("got 0 bytes, want 1")
+	}
+	out := s.buf[0]
+	s.buf = s.buf[1:]
+	return out, nil
+}
+
 // scanLiteral advances past the specified prefix of the input.
 func (s *scanner) scanLiteral(want string) error {
 	rest, ok := bytes.CutPrefix(s.buf, []byte(want))
@@ -403,12 +1530,11 @@ func (s *scanner) scanString() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	n := int(n32)
-	if n > len(s.buf) {
-		return nil, fmt.Errorf("got %d bytes, want %d", len(s.buf), n)
+	if uint64(n32) > uint64(len(s.buf)) {
+		return nil, fmt.Errorf("got %d bytes, want %d", len(s.buf), n32)
 	}
-	out := s.buf[:n]
-	s.buf = s.buf[n:]
+	out := s.buf[:n32]
+	s.buf = s.buf[n32:]
 	return out, nil
 }
 
@@ -0,0 +1,358 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tskagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tailscale/setec/types/api"
+)
+
+// An UpdateResult reports the effect of a call to [Server.Update]. Each list
+// gives the names of secrets, in lexicographic order.
+type UpdateResult struct {
+	Added   []string // secrets whose keys were added
+	Removed []string // secrets whose keys were removed
+	Changed []string // secrets whose key or certificate version changed
+	Kept    []string // secrets whose keys were unchanged, including failures
+
+	// Failed maps the names of secrets that could not be fetched to the
+	// errors that occurred.
+	Failed map[string]error
+
+	// Missing lists the failed secrets for which there were no earlier keys
+	// to keep, for example because the agent had just started. An update
+	// with missing secrets is not saved to the cache.
+	Missing []string
+}
+
+// Err returns an error combining the failures in r, or nil if there were
+// none.
+func (r *UpdateResult) Err() error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(r.Failed)) {
+		errs = append(errs, r.Failed[name])
+	}
+	return errors.Join(errs...)
+}
+
+// String returns a human-readable summary of r, suitable for logging.
+func (r *UpdateResult) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "added %d, removed %d, changed %d, kept %d",
+		len(r.Added), len(r.Removed), len(r.Changed), len(r.Kept))
+	if len(r.Failed) != 0 {
+		fmt.Fprintf(&sb, ", failed %d", len(r.Failed))
+	}
+	return sb.String()
+}
+
+// diff populates the Added, Removed, Changed, and Kept fields of r from the
+// old and current sets of keys from the secrets service.
+func (r *UpdateResult) diff(old, cur map[string]*sshKey) {
+	type version struct{ key, cert, pass api.SecretVersion }
+	versions := func(m map[string]*sshKey) map[string]version {
+		out := make(map[string]version)
+		for _, key := range m {
+			out[key.Name] = version{key.Version, key.CertVersion, key.PassVersion}
+		}
+		return out
+	}
+	ov, nv := versions(old), versions(cur)
+	for name, v := range nv {
+		if o, ok := ov[name]; !ok {
+			r.Added = append(r.Added, name)
+		} else if o != v {
+			r.Changed = append(r.Changed, name)
+		} else {
+			r.Kept = append(r.Kept, name)
+		}
+	}
+	for name := range ov {
+		if _, ok := nv[name]; !ok {
+			r.Removed = append(r.Removed, name)
+		}
+	}
+	slices.Sort(r.Added)
+	slices.Sort(r.Removed)
+	slices.Sort(r.Changed)
+	slices.Sort(r.Kept)
+}
+
+// UpdateStatus reports the outcome of updates from the secrets service.
+type UpdateStatus struct {
+	LastAttempt time.Time     // when the last update started
+	LastSuccess time.Time     // when the last successful update started
+	LastPartial time.Time     // when the last update that applied only some secrets started
+	LastError   error         // the error from the last update, or nil
+	LastResult  *UpdateResult // the result of the last update, if any
+	Failures    int           // the number of consecutive updates that failed, in whole or in part
+
+	// NextUpdate is when [Server.Run] will next update the keys, or zero if
+	// it is not running.
+	NextUpdate time.Time
+
+	// MaxStale is the default maximum staleness of keys (Config.MaxStale),
+	// and Staleness is the time since the least recently confirmed key from
+	// the secrets service was confirmed current by an update, including a
+	// partial update (zero if there are no such keys). StaleKeys lists the
+	// names of secrets whose keys are withheld because they have not been
+	// confirmed current within their maximum staleness.
+	MaxStale  time.Duration
+	Staleness time.Duration
+	StaleKeys []string
+}
+
+// UpdateStatus reports the current update status of s.
+func (s *Server) UpdateStatus() UpdateStatus {
+	s.statusμ.Lock()
+	st := s.status
+	s.statusμ.Unlock()
+
+	now := time.Now()
+	st.MaxStale = s.maxStale
+	s.μ.Lock()
+	defer s.μ.Unlock()
+	for _, key := range s.keys {
+		if !key.Checked.IsZero() {
+			st.Staleness = max(st.Staleness, now.Sub(key.Checked))
+		}
+		if s.isStale(key, now) {
+			st.StaleKeys = append(st.StaleKeys, key.Name)
+		}
+	}
+	slices.Sort(st.StaleKeys)
+	st.StaleKeys = slices.Compact(st.StaleKeys) // bundled keys share a name
+	return st
+}
+
+// supersedeLocked records the keys of s that are replaced in cur by keys
+// from newer versions of their secrets, so that they continue to be served
+// for the rotation grace period as of now, and discards superseded keys
+// whose grace period has ended. The caller must hold s.μ.
+func (s *Server) supersedeLocked(cur map[string]*sshKey, now time.Time) {
+	for id, key := range s.previous {
+		if key.expired(now) || cur[id] != nil {
+			delete(s.previous, id)
+		}
+	}
+	if s.rotationGrace <= 0 {
+		return
+	}
+	latest := make(map[string]api.SecretVersion)
+	for _, key := range cur {
+		latest[key.Name] = key.Version
+	}
+	for id, key := range s.keys {
+		v, ok := latest[key.Name]
+		if !ok || v == key.Version || cur[id] != nil {
+			continue // deleted, unchanged, or the new version has the same key
+		}
+		old := *key
+		old.Comment = strings.TrimSpace(fmt.Sprintf("%s (superseded by version %d)", key.Comment, v))
+		if exp := now.Add(s.rotationGrace); old.Expires.IsZero() || exp.Before(old.Expires) {
+			old.Expires = exp
+		}
+		if s.previous == nil {
+			s.previous = make(map[string]*sshKey)
+		}
+		s.previous[id] = &old
+		s.logPrintf("[update] serving superseded %q version %d until %s",
+			key.Name, key.Version, old.Expires.Format(time.RFC3339))
+	}
+}
+
+// maxStaleFor returns the maximum staleness of key, or 0 if it has none.
+func (s *Server) maxStaleFor(key *sshKey) time.Duration {
+	if key.Name == "" {
+		return 0 // keys added by clients do not come from setec
+	} else if key.Policy != nil && key.Policy.MaxStale != 0 {
+		return max(key.Policy.MaxStale, 0)
+	}
+	return max(s.maxStale, 0)
+}
+
+// isStale reports whether key has not been confirmed current by an update
+// within its maximum staleness as of now.
+func (s *Server) isStale(key *sshKey, now time.Time) bool {
+	d := s.maxStaleFor(key)
+	return d > 0 && now.Sub(key.Checked) > d
+}
+
+// logStaleness logs a warning if any keys are withheld as stale.
+func (s *Server) logStaleness() {
+	st := s.UpdateStatus()
+	if len(st.StaleKeys) != 0 {
+		s.logPrintf("WARNING: Withholding stale keys from %q; oldest was confirmed %v ago",
+			st.StaleKeys, st.Staleness.Round(time.Second))
+	}
+}
+
+// recordUpdate records the outcome of an update that began at start. An
+// update is partial if it failed for some secrets, but applied the rest.
+func (s *Server) recordUpdate(start time.Time, res *UpdateResult, err error) {
+	s.statusμ.Lock()
+	defer s.statusμ.Unlock()
+	s.status.LastAttempt = start
+	s.status.LastError = err
+	if res != nil {
+		s.status.LastResult = res
+	}
+	if err == nil {
+		s.status.LastSuccess = start
+		s.status.Failures = 0
+	} else {
+		if res != nil && !s.strictUpdate {
+			s.status.LastPartial = start
+		}
+		s.status.Failures++
+	}
+}
+
+// setNextUpdate records when the next periodic update is due.
+func (s *Server) setNextUpdate(next time.Time) {
+	s.statusμ.Lock()
+	defer s.statusμ.Unlock()
+	s.status.NextUpdate = next
+}
+
+// An UpdatePolicy controls periodic updates by [Server.Run].
+type UpdatePolicy struct {
+	// Interval is the time between updates, while they succeed. It must be
+	// positive.
+	Interval time.Duration
+
+	// RetryDelay is the time to wait before retrying after an update fails.
+	// The delay doubles after each consecutive failure, up to MaxRetryDelay.
+	// If zero, the smaller of Interval and 5 seconds is used.
+	RetryDelay time.Duration
+
+	// MaxRetryDelay is the longest time to wait between retries. If zero,
+	// Interval is used.
+	MaxRetryDelay time.Duration
+
+	// Jitter is the fraction of each delay that is randomized, so that agents
+	// started together do not all contact the secrets service at once. For
+	// example, with Jitter 0.1, each delay is between 90% and 110% of its
+	// nominal value. If zero, 0.1 is used. If negative, delays are not
+	// randomized.
+	Jitter float64
+}
+
+// withDefaults returns a copy of p with default values filled in.
+func (p UpdatePolicy) withDefaults() UpdatePolicy {
+	if p.RetryDelay <= 0 {
+		p.RetryDelay = min(p.Interval, 5*time.Second)
+	}
+	if p.MaxRetryDelay <= 0 {
+		p.MaxRetryDelay = p.Interval
+	}
+	p.MaxRetryDelay = max(p.MaxRetryDelay, p.RetryDelay)
+	if p.Jitter == 0 {
+		p.Jitter = 0.1
+	}
+	p.Jitter = min(p.Jitter, 1)
+	return p
+}
+
+// delay returns the nominal delay before the next update, given the number of
+// consecutive failures so far.
+func (p UpdatePolicy) delay(failures int) time.Duration {
+	if failures == 0 {
+		return p.Interval
+	}
+	d := p.RetryDelay
+	for range failures - 1 {
+		if d >= p.MaxRetryDelay {
+			break
+		}
+		d *= 2
+	}
+	return min(d, p.MaxRetryDelay)
+}
+
+// jitter returns d randomized according to p.
+func (p UpdatePolicy) jitter(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	f := 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(d) * f)
+}
+
+// Run updates the keys of s periodically according to p, until ctx ends.
+// The caller should call [Server.Update] before Run to initialize the keys;
+// Run waits for the first interval before its first update.
+//
+// When an update fails, Run retries with exponential backoff, as described by
+// p. Run reports an error only if p is invalid; otherwise it returns nil when
+// ctx ends. Use [Server.UpdateStatus] to check the outcome of updates.
+func (s *Server) Run(ctx context.Context, p UpdatePolicy) error {
+	if p.Interval <= 0 {
+		return fmt.Errorf("invalid update interval %v", p.Interval)
+	}
+	p = p.withDefaults()
+	defer s.setNextUpdate(time.Time{})
+	if s.maxStale > 0 {
+		s.logPrintf("Updating every %v; keys are withheld if not updated within %v", p.Interval, s.maxStale)
+	}
+
+	for {
+		d := p.jitter(p.delay(s.UpdateStatus().Failures))
+		s.setNextUpdate(time.Now().Add(d))
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+		if _, err := s.Update(ctx); err != nil && ctx.Err() == nil {
+			st := s.UpdateStatus()
+			s.logPrintf("WARNING: Update failed (%d consecutive failures): %v", st.Failures, err)
+		}
+	}
+}
+
+// missUpdateTimeout bounds the time a request waits for an on-demand update.
+const missUpdateTimeout = 30 * time.Second
+
+// updateOnMiss runs an on-demand update after a request that began at begin
+// failed to find a key, if on-demand updates are enabled and the last one was
+// not too recent. It reports whether an update finished after begin, in which
+// case the caller should retry the request.
+//
+// If another on-demand update is already running, updateOnMiss waits for it
+// to finish rather than starting another.
+func (s *Server) updateOnMiss(begin time.Time) bool {
+	if s.missInterval <= 0 {
+		return false
+	}
+	s.missμ.Lock()
+	defer s.missμ.Unlock()
+	if s.missDone.After(begin) {
+		return true // another update finished since the request began
+	}
+	now := time.Now()
+	if now.Sub(s.missLast) < s.missInterval {
+		return false // too soon since the last one
+	}
+	s.missLast = now
+	defer func() { s.missDone = time.Now() }()
+
+	s.logPrintf("[update] key not found; updating on demand")
+	ctx, cancel := context.WithTimeout(context.Background(), missUpdateTimeout)
+	defer cancel()
+	if _, err := s.Update(ctx); err != nil {
+		s.logPrintf("WARNING: On-demand update failed: %v", err)
+	}
+	return true
+}